@@ -0,0 +1,54 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFake(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	f := NewFake(start)
+	timer := f.NewTimer(time.Second)
+	ticker := f.NewTicker(time.Second * 3)
+	after := f.After(time.Second * 5)
+	if f.Waiters() != 3 {
+		t.Fatalf("Waiters() = %v", f.Waiters())
+	}
+
+	f.Advance(time.Millisecond * 999)
+	select {
+	case <-timer.C():
+		t.Fatal("the timer fired early")
+	default:
+	}
+	f.Advance(time.Millisecond)
+	if v := <-timer.C(); !v.Equal(start.Add(time.Second)) {
+		t.Fatalf("the timer fired at %v", v)
+	}
+	if timer.Stop() {
+		t.Fatal("Stop() of a fired timer should return false")
+	}
+
+	f.Advance(time.Second * 6)
+	if v := <-ticker.C(); !v.Equal(start.Add(time.Second * 3)) {
+		t.Fatalf("the ticker fired at %v, the second tick should be dropped", v)
+	}
+	if v := <-after; !v.Equal(start.Add(time.Second * 5)) {
+		t.Fatalf("After fired at %v", v)
+	}
+	if !f.Now().Equal(start.Add(time.Second * 7)) {
+		t.Fatalf("Now() = %v", f.Now())
+	}
+	ticker.Stop()
+
+	timer.Reset(time.Second)
+	done := make(chan struct{})
+	go func() {
+		<-f.After(time.Second)
+		close(done)
+	}()
+	f.BlockUntil(2)
+	f.Advance(time.Second)
+	<-done
+	<-timer.C()
+}
@@ -0,0 +1,169 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock which only moves when told to. Timers and tickers fire while Advance passes
+// their deadlines, in order, and like the time package, a tick is dropped if the
+// channel still holds the previous one.
+type Fake struct {
+	lock    sync.Mutex
+	cond    *sync.Cond
+	now     time.Time
+	waiters map[*fakeWaiter]struct{}
+}
+
+type fakeWaiter struct {
+	deadline time.Time
+	period   time.Duration // Zero for timers.
+	ch       chan time.Time
+}
+
+func NewFake(now time.Time) *Fake {
+	f := &Fake{
+		now:     now,
+		waiters: make(map[*fakeWaiter]struct{}),
+	}
+	f.cond = sync.NewCond(&f.lock)
+	return f
+}
+
+func (f *Fake) Now() time.Time {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.now
+}
+
+func (f *Fake) After(d time.Duration) <-chan time.Time {
+	return f.NewTimer(d).C()
+}
+
+func (f *Fake) NewTimer(d time.Duration) Timer {
+	w := &fakeWaiter{ch: make(chan time.Time, 1)}
+	f.schedule(w, d)
+	return &fakeTimer{f, w}
+}
+
+func (f *Fake) NewTicker(d time.Duration) Ticker {
+	if d <= 0 {
+		panic("non-positive interval for NewTicker")
+	}
+	w := &fakeWaiter{ch: make(chan time.Time, 1), period: d}
+	f.schedule(w, d)
+	return &fakeTicker{f, w}
+}
+
+// Arms w to fire after d, it fires right away if d isn't positive.
+func (f *Fake) schedule(w *fakeWaiter, d time.Duration) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, active := f.waiters[w]
+	if d <= 0 && w.period == 0 {
+		delete(f.waiters, w)
+		w.fire(f.now)
+		return active
+	}
+	w.deadline = f.now.Add(d)
+	f.waiters[w] = struct{}{}
+	f.cond.Broadcast()
+	return active
+}
+
+func (f *Fake) stop(w *fakeWaiter) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	_, active := f.waiters[w]
+	delete(f.waiters, w)
+	return active
+}
+
+func (w *fakeWaiter) fire(now time.Time) {
+	select {
+	case w.ch <- now:
+	default:
+	}
+}
+
+// Moves the clock forward by d, firing the timers and tickers due on the way.
+func (f *Fake) Advance(d time.Duration) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	target := f.now.Add(d)
+	for {
+		var next *fakeWaiter
+		for w := range f.waiters {
+			if !w.deadline.After(target) && (next == nil || w.deadline.Before(next.deadline)) {
+				next = w
+			}
+		}
+		if next == nil {
+			break
+		}
+		if next.deadline.After(f.now) {
+			f.now = next.deadline
+		}
+		next.fire(f.now)
+		if next.period > 0 {
+			next.deadline = next.deadline.Add(next.period)
+		} else {
+			delete(f.waiters, next)
+		}
+	}
+	f.now = target
+}
+
+// Returns the number of timers and tickers armed.
+func (f *Fake) Waiters() int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return len(f.waiters)
+}
+
+// Blocks until at least n timers and tickers are armed, so a test knows the code
+// under test is waiting before it advances the clock.
+func (f *Fake) BlockUntil(n int) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for len(f.waiters) < n {
+		f.cond.Wait()
+	}
+}
+
+type fakeTimer struct {
+	f *Fake
+	w *fakeWaiter
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.w.ch
+}
+
+func (t *fakeTimer) Stop() bool {
+	return t.f.stop(t.w)
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	return t.f.schedule(t.w, d)
+}
+
+type fakeTicker struct {
+	f *Fake
+	w *fakeWaiter
+}
+
+func (t *fakeTicker) C() <-chan time.Time {
+	return t.w.ch
+}
+
+func (t *fakeTicker) Stop() {
+	t.f.stop(t.w)
+}
+
+func (t *fakeTicker) Reset(d time.Duration) {
+	if d <= 0 {
+		panic("non-positive interval for Ticker.Reset")
+	}
+	t.f.schedule(t.w, d)
+}
@@ -0,0 +1,52 @@
+package concurrentMap
+
+import (
+	"hash"
+	"hash/fnv"
+	"sync/atomic"
+)
+
+// Counters of a map, collected since it was created.
+type Stats struct {
+	Hits        int64
+	Misses      int64
+	Evictions   int64
+	Expirations int64
+}
+
+// Creates a new concurrent map which holds at most capacity elements,
+// the policy picks the element dropped when the map is full.
+func BoundedNew(hasher func() hash.Hash32, sc, capacity int, policy EvictPolicy) *ConcurrentMap {
+	if hasher == nil {
+		hasher = fnv.New32
+	}
+	return NewBoundedMap[string, interface{}](StringHasher(hasher), sc, capacity, policy)
+}
+
+// Creates a new concurrent map of type K:V which holds at most capacity elements.
+// The policy picks the victim within the shard written to, or within the other shards
+// if that one is empty, so the order of evictions is only approximate across shards.
+// Concurrent inserts may go over capacity for the moment they take to evict.
+func NewBoundedMap[K comparable, V any](hasher func(K) uint32, sc, capacity int, policy EvictPolicy) *Map[K, V] {
+	m := NewMap[K, V](hasher, sc)
+	if capacity <= 0 {
+		return m
+	}
+	m.capacity = int64(capacity)
+	for _, shard := range m.shards {
+		shard.capacity = m.capacity
+		shard.size = &m.size
+		shard.policy = newEvictPolicy[K](policy)
+	}
+	return m
+}
+
+// Returns a snapshot of the hit, miss and eviction counters.
+func (m *Map[K, V]) Stats() Stats {
+	return Stats{
+		Hits:        atomic.LoadInt64(&m.hits),
+		Misses:      atomic.LoadInt64(&m.misses),
+		Evictions:   atomic.LoadInt64(&m.evictions),
+		Expirations: atomic.LoadInt64(&m.expirations),
+	}
+}
@@ -0,0 +1,64 @@
+package concurrentMap
+
+// Sets the value returned by f under the specified key and returns it.
+// f receives the current value and runs under the shard lock, so it must not access the map.
+// The ttl of an existing element is kept.
+func (m *Map[K, V]) Upsert(key K, f func(old V, exists bool) V) V {
+	val, _ := m.Compute(key, func(old V, exists bool) (V, bool) {
+		return f(old, exists), true
+	})
+	return val
+}
+
+// Replaces the element under the specified key with the value returned by f, the element
+// is removed if f returns false. Returns the new value and whether it is stored.
+// f receives the current value and runs under the shard lock, so it must not access the map.
+// The ttl of an existing element is kept.
+func (m *Map[K, V]) Compute(key K, f func(old V, exists bool) (V, bool)) (V, bool) {
+	var evicted []Entry[K, V]
+	shard := m.GetShard(key)
+	shard.lock()
+	expired, exists := shard.lookupLocked(key, m.now())
+	old := shard.items[key]
+	val, keep := f(old, exists)
+	if keep {
+		evicted = shard.set(key, val, shard.expires[key])
+	} else if exists {
+		shard.remove(key, EventRemove)
+	}
+	shard.Unlock()
+	m.expired(expired)
+	m.evicted(evicted)
+	return val, keep
+}
+
+// Removes the element under the specified key if predicate returns true for its value.
+// predicate runs under the shard lock, so it must not access the map.
+func (m *Map[K, V]) RemoveIf(key K, predicate func(val V) bool) bool {
+	shard := m.GetShard(key)
+	shard.lock()
+	expired, ok := shard.lookupLocked(key, m.now())
+	removed := ok && predicate(shard.items[key])
+	if removed {
+		shard.remove(key, EventRemove)
+	}
+	shard.Unlock()
+	m.expired(expired)
+	return removed
+}
+
+// Swaps the element under the specified key to new if its current value equals old.
+// Like sync.Map, it panics if the values are not comparable.
+// The ttl of the element is kept.
+func (m *Map[K, V]) CompareAndSwap(key K, old, new V) bool {
+	shard := m.GetShard(key)
+	shard.lock()
+	expired, ok := shard.lookupLocked(key, m.now())
+	swapped := ok && any(shard.items[key]) == any(old)
+	if swapped {
+		shard.set(key, new, shard.expires[key])
+	}
+	shard.Unlock()
+	m.expired(expired)
+	return swapped
+}
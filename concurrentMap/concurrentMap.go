@@ -1,128 +1,240 @@
 package concurrentMap
 
 import (
+	"github.com/athlum/pkg/clock"
+	"github.com/athlum/pkg/exitChan"
 	"hash"
 	"hash/fnv"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 )
 
 var SHARD_COUNT = 16
 
-// A "thread" safe map of type string:Anything.
-// To avoid lock bottlenecks this map is dived to several (SHARD_COUNT) map shards.
-type ConcurrentMap struct {
-	shards []*ConcurrentMapShared
-	hasher func() hash.Hash32
+// A "thread" safe map of type K:V.
+// To avoid lock bottlenecks this map is dived to several map shards, SHARD_COUNT by default.
+type Map[K comparable, V any] struct {
+	shards      []*MapShared[K, V]
+	hasher      func(K) uint32
+	hub         *watchHub[K, V]
+	clock       clock.Clock
+	onEvict     atomic.Value
+	decoder     atomic.Value
+	stop        *exitChan.ExitChan
+	hits        int64
+	misses      int64
+	evictions   int64
+	expirations int64
+	loadErrTTL  int64
+	capacity    int64 // Zero if unbounded.
+	size        int64 // Elements held, only counted if bounded.
 }
 
-// A "thread" safe string to anything map.
-type ConcurrentMapShared struct {
-	items        map[string]interface{}
-	sync.RWMutex // Read Write mutex, guards access to internal map.
+// A "thread" safe K to V map.
+type MapShared[K comparable, V any] struct {
+	items        map[K]V
+	expires      map[K]int64 // Deadlines in unix nanoseconds of keys set with a ttl.
+	capacity     int64       // Of the whole map.
+	size         *int64      // Elements held by the whole map.
+	policy       evictPolicy[K]
+	loads        map[K]*loadCall[V]
+	loadErrs     map[K]loadError
+	hub          *watchHub[K, V]
+	metrics      atomic.Pointer[shardMetrics]
+	plock        sync.Mutex // Guards policy against concurrent readers.
+	sync.RWMutex            // Read Write mutex, guards access to internal map.
 }
 
+// A "thread" safe map of type string:Anything.
+type ConcurrentMap = Map[string, interface{}]
+
+// A "thread" safe string to anything map.
+type ConcurrentMapShared = MapShared[string, interface{}]
+
 // Creates a new concurrent map.
 func New() *ConcurrentMap {
 	return AdvanceNew(fnv.New32, SHARD_COUNT)
 }
 
 func AdvanceNew(hasher func() hash.Hash32, sc int) *ConcurrentMap {
+	if hasher == nil {
+		hasher = fnv.New32
+	}
+	return NewMap[string, interface{}](StringHasher(hasher), sc)
+}
+
+// Creates a new concurrent map of type K:V, keys are routed to shards by hasher.
+// A nil hasher falls back to maphash with a per map seed.
+func NewMap[K comparable, V any](hasher func(K) uint32, sc int) *Map[K, V] {
 	if sc == 0 {
 		sc = SHARD_COUNT
 	}
 	if hasher == nil {
-		hasher = fnv.New32
+		hasher = ComparableHasher[K]()
+	}
+	m := &Map[K, V]{
+		shards: make([]*MapShared[K, V], sc),
+		hasher: hasher,
+		hub:    &watchHub[K, V]{},
+		stop:   exitChan.NewExitChan(),
 	}
-	m := &ConcurrentMap{make([]*ConcurrentMapShared, sc), hasher}
 	for i := 0; i < sc; i++ {
-		m.shards[i] = &ConcurrentMapShared{items: make(map[string]interface{})}
+		m.shards[i] = &MapShared[K, V]{
+			items:   make(map[K]V),
+			expires: make(map[K]int64),
+			hub:     m.hub,
+		}
 	}
 	return m
 }
 
+// Prepares a zero Map, so it could be the target of a decoder.
+func (m *Map[K, V]) init() {
+	if m.shards != nil {
+		return
+	}
+	n := NewMap[K, V](nil, 0)
+	m.shards, m.hasher, m.hub, m.stop = n.shards, n.hasher, n.hub, n.stop
+}
+
+// Adapts a hash.Hash32 constructor to a string key hasher.
+func StringHasher(hasher func() hash.Hash32) func(string) uint32 {
+	return func(key string) uint32 {
+		h := hasher()
+		h.Write([]byte(key))
+		return h.Sum32()
+	}
+}
+
+// Hashes any comparable key with maphash, seeded once per call.
+func ComparableHasher[K comparable]() func(K) uint32 {
+	seed := maphash.MakeSeed()
+	return func(key K) uint32 {
+		return uint32(maphash.Comparable(seed, key))
+	}
+}
+
 // Returns shard under given key
-func (m *ConcurrentMap) GetShard(key string) *ConcurrentMapShared {
-	hasher := m.hasher()
-	hasher.Write([]byte(key))
-	return m.shards[uint(hasher.Sum32())%uint(SHARD_COUNT)]
+func (m *Map[K, V]) GetShard(key K) *MapShared[K, V] {
+	return m.shards[uint(m.hasher(key))%uint(len(m.shards))]
+}
+
+// Returns the number of shards of the map.
+func (m *Map[K, V]) ShardCount() int {
+	return len(m.shards)
 }
 
-func (m *ConcurrentMap) MSet(data map[string]interface{}) {
+func (m *Map[K, V]) MSet(data map[K]V) {
 	for key, value := range data {
 		shard := m.GetShard(key)
-		shard.Lock()
-		shard.items[key] = value
+		shard.count(opSet)
+		shard.lock()
+		evicted := shard.set(key, value, 0)
 		shard.Unlock()
+		m.evicted(evicted)
 	}
 }
 
 // Sets the given value under the specified key.
-func (m *ConcurrentMap) Set(key string, value interface{}) {
+func (m *Map[K, V]) Set(key K, value V) {
 	// Get map shard.
 	shard := m.GetShard(key)
-	shard.Lock()
-	shard.items[key] = value
+	shard.count(opSet)
+	shard.lock()
+	evicted := shard.set(key, value, 0)
 	shard.Unlock()
+	m.evicted(evicted)
 }
 
 // Sets the given value under the specified key if no value was associated with it.
-func (m *ConcurrentMap) SetIfAbsent(key string, value interface{}) bool {
+func (m *Map[K, V]) SetIfAbsent(key K, value V) bool {
 	// Get map shard.
 	shard := m.GetShard(key)
-	shard.Lock()
-	_, ok := shard.items[key]
+	shard.lock()
+	var evicted []Entry[K, V]
+	expired, ok := shard.lookupLocked(key, m.now())
 	if !ok {
-		shard.items[key] = value
+		evicted = shard.set(key, value, 0)
 	}
 	shard.Unlock()
+	m.expired(expired)
+	m.evicted(evicted)
 	return !ok
 }
 
 // Retrieves an element from map under given key.
-func (m *ConcurrentMap) Get(key string) (interface{}, bool) {
+func (m *Map[K, V]) Get(key K) (V, bool) {
 	// Get shard
 	shard := m.GetShard(key)
-	shard.RLock()
+	shard.count(opGet)
+	shard.rlock()
 	// Get item from shard.
 	val, ok := shard.items[key]
+	expired := ok && shard.expired(key, m.now())
+	if ok && !expired {
+		shard.access(key)
+	}
 	shard.RUnlock()
+	if expired {
+		m.expire(shard, key)
+	}
+	if !ok || expired {
+		atomic.AddInt64(&m.misses, 1)
+		var zero V
+		return zero, false
+	}
+	atomic.AddInt64(&m.hits, 1)
 	return val, ok
 }
 
-func (m *ConcurrentMap) GetOrSet(key string, value interface{}) (interface{}, bool) {
+func (m *Map[K, V]) GetOrSet(key K, value V) (V, bool) {
 	shard := m.GetShard(key)
 	var created bool
-	shard.Lock()
-	val, ok := shard.items[key]
+	var evicted []Entry[K, V]
+	shard.lock()
+	expired, ok := shard.lookupLocked(key, m.now())
+	val := shard.items[key]
 	if !ok {
-		shard.items[key] = value
+		evicted = shard.set(key, value, 0)
 		val = value
 		created = true
 	}
 	shard.Unlock()
+	m.expired(expired)
+	m.evicted(evicted)
 	return val, created
 }
 
-func (m *ConcurrentMap) GetOrBlock(key string, handler func() map[string]interface{}) (interface{}, bool) {
-	shard := m.GetShard(key)
-	shard.Lock()
-	val, ok := shard.items[key]
-	if !ok && handler != nil {
-		for k, v := range handler() {
-			shard.items[k] = v
-		}
-		val, ok = shard.items[key]
+// Retrieves an element from map under given key, fills the map with the result of handler if absent.
+//
+// Deprecated: GetOrBlock is a wrapper of GetOrLoad, use GetOrLoad instead.
+func (m *Map[K, V]) GetOrBlock(key K, handler func() map[K]V) (V, bool) {
+	if handler == nil {
+		return m.Get(key)
 	}
-	defer shard.Unlock()
-	return val, ok
+	val, err := m.GetOrLoad(key, func() (V, error) {
+		data := handler()
+		for k, v := range data {
+			if k != key {
+				m.Set(k, v)
+			}
+		}
+		val, ok := data[key]
+		if !ok {
+			return val, ERROR_NotLoaded
+		}
+		return val, nil
+	})
+	return val, err == nil
 }
 
 // Returns the number of elements within the map.
-func (m *ConcurrentMap) Count() int {
+// Expired elements are counted until they are swept.
+func (m *Map[K, V]) Count() int {
 	count := 0
-	for i := 0; i < SHARD_COUNT; i++ {
-		shard := m.shards[i]
-		shard.RLock()
+	for _, shard := range m.shards {
+		shard.rlock()
 		count += len(shard.items)
 		shard.RUnlock()
 	}
@@ -130,89 +242,163 @@ func (m *ConcurrentMap) Count() int {
 }
 
 // Looks up an item under specified key
-func (m *ConcurrentMap) Has(key string) bool {
+func (m *Map[K, V]) Has(key K) bool {
 	// Get shard
 	shard := m.GetShard(key)
-	shard.RLock()
+	shard.rlock()
 	// See if element is within shard.
 	_, ok := shard.items[key]
+	expired := ok && shard.expired(key, m.now())
 	shard.RUnlock()
+	if expired {
+		m.expire(shard, key)
+		return false
+	}
 	return ok
 }
 
 // Removes an element from the map.
-func (m *ConcurrentMap) Remove(key string) bool {
+func (m *Map[K, V]) Remove(key K) bool {
 	// Try to get shard.
 	shard := m.GetShard(key)
-	shard.Lock()
-	defer shard.Unlock()
-	_, ok := shard.items[key]
-	delete(shard.items, key)
+	shard.count(opRemove)
+	shard.lock()
+	expired, ok := shard.lookupLocked(key, m.now())
+	shard.remove(key, EventRemove)
+	shard.Unlock()
+	m.expired(expired)
 	return ok
 }
 
 // Checks if map is empty.
-func (m *ConcurrentMap) IsEmpty() bool {
+func (m *Map[K, V]) IsEmpty() bool {
 	return m.Count() == 0
 }
 
 // Used by the Iter & IterBuffered functions to wrap two variables together over a channel,
-type Tuple struct {
-	Key string
-	Val interface{}
+type Tuple = Entry[string, interface{}]
+
+// A key value pair of a Map.
+type Entry[K comparable, V any] struct {
+	Key K
+	Val V
 }
 
 // Returns a buffered iterator which could be used in a for range loop.
-func (m *ConcurrentMap) IterBuffered() <-chan Tuple {
-	ch := make(chan Tuple, m.Count())
-	go func() {
-		wg := sync.WaitGroup{}
-		wg.Add(SHARD_COUNT)
-		// Foreach shard.
-		for _, shard := range m.shards {
-			go func(shard *ConcurrentMapShared) {
-				// Foreach key, value pair.
-				shard.RLock()
-				for key, val := range shard.items {
-					ch <- Tuple{key, val}
-				}
-				shard.RUnlock()
-				wg.Done()
-			}(shard)
-		}
-		wg.Wait()
-		close(ch)
-	}()
+// The channel holds every element when returned, no goroutine is left behind.
+func (m *Map[K, V]) IterBuffered() <-chan Entry[K, V] {
+	var entries []Entry[K, V]
+	for _, shard := range m.shards {
+		entries = shard.appendEntries(entries, m.now())
+	}
+	ch := make(chan Entry[K, V], len(entries))
+	for _, e := range entries {
+		ch <- e
+	}
+	close(ch)
 	return ch
 }
 
-// Return all keys as []string
-func (m *ConcurrentMap) Keys() []string {
-	count := m.Count()
-	ch := make(chan string, count)
-	go func() {
-		// Foreach shard.
-		wg := sync.WaitGroup{}
-		wg.Add(SHARD_COUNT)
-		for _, shard := range m.shards {
-			go func(shard *ConcurrentMapShared) {
-				// Foreach key, value pair.
-				shard.RLock()
-				for key := range shard.items {
-					ch <- key
-				}
-				shard.RUnlock()
-				wg.Done()
-			}(shard)
+// Return all keys as []K
+func (m *Map[K, V]) Keys() []K {
+	ts := m.now()
+	keys := make([]K, 0, m.Count())
+	for _, shard := range m.shards {
+		shard.rlock()
+		for key := range shard.items {
+			if !shard.expired(key, ts) {
+				keys = append(keys, key)
+			}
 		}
-		wg.Wait()
-		close(ch)
-	}()
-
-	// Generate keys
-	keys := make([]string, count)
-	for i := 0; i < count; i++ {
-		keys[i] = <-ch
+		shard.RUnlock()
 	}
 	return keys
 }
+
+// Calls f sequentially for each element, stops if f returns false.
+// Each shard is copied before f is called on its elements, so f is free to access the map.
+func (m *Map[K, V]) Range(f func(key K, val V) bool) {
+	for _, shard := range m.shards {
+		for _, e := range shard.appendEntries(nil, m.now()) {
+			if !f(e.Key, e.Val) {
+				return
+			}
+		}
+	}
+}
+
+// Returns all elements as map[K]V, copied shard by shard.
+func (m *Map[K, V]) Items() map[K]V {
+	ts := m.now()
+	items := make(map[K]V, m.Count())
+	for _, shard := range m.shards {
+		shard.rlock()
+		for key, val := range shard.items {
+			if !shard.expired(key, ts) {
+				items[key] = val
+			}
+		}
+		shard.RUnlock()
+	}
+	return items
+}
+
+// Returns a consistent copy of all elements, every shard is locked while copying.
+func (m *Map[K, V]) Snapshot() map[K]V {
+	for _, shard := range m.shards {
+		shard.rlock()
+	}
+	ts := m.now()
+	count := 0
+	for _, shard := range m.shards {
+		count += len(shard.items)
+	}
+	items := make(map[K]V, count)
+	for _, shard := range m.shards {
+		for key, val := range shard.items {
+			if !shard.expired(key, ts) {
+				items[key] = val
+			}
+		}
+	}
+	for _, shard := range m.shards {
+		shard.RUnlock()
+	}
+	return items
+}
+
+// Removes all elements from the map.
+func (m *Map[K, V]) Clear() {
+	for _, shard := range m.shards {
+		shard.lock()
+		for key := range shard.items {
+			shard.remove(key, EventRemove)
+		}
+		shard.Unlock()
+	}
+}
+
+// Removes an element from the map and returns it.
+func (m *Map[K, V]) Pop(key K) (V, bool) {
+	shard := m.GetShard(key)
+	shard.count(opRemove)
+	shard.lock()
+	expired, ok := shard.lookupLocked(key, m.now())
+	val := shard.items[key]
+	shard.remove(key, EventRemove)
+	shard.Unlock()
+	m.expired(expired)
+	return val, ok
+}
+
+// Appends the live elements of a shard to entries.
+func (s *MapShared[K, V]) appendEntries(entries []Entry[K, V], now int64) []Entry[K, V] {
+	s.rlock()
+	for key, val := range s.items {
+		if !s.expired(key, now) {
+			entries = append(entries, Entry[K, V]{key, val})
+		}
+	}
+	s.RUnlock()
+	return entries
+}
@@ -1,12 +1,21 @@
 package concurrentMap
 
 import (
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"github.com/athlum/pkg/clock"
 	"hash"
 	"hash/adler32"
 	"hash/fnv"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"time"
 )
 
 var (
@@ -122,3 +131,445 @@ func BenchmarkAdlerLong(b *testing.B) {
 func BenchmarkFnvLong(b *testing.B) {
 	hashFunc(l, fnv.New32, b)
 }
+
+func TestGenericMap(t *testing.T) {
+	gm := NewMap[int, string](nil, 0)
+	gm.Set(1, "a")
+	if !gm.SetIfAbsent(2, "b") || gm.SetIfAbsent(2, "c") {
+		t.Fatal("SetIfAbsent should only set absent keys")
+	}
+	if v, ok := gm.Get(2); !ok || v != "b" {
+		t.Fatalf("Get(2) = %v, %v", v, ok)
+	}
+	if v, created := gm.GetOrSet(1, "x"); created || v != "a" {
+		t.Fatalf("GetOrSet(1) = %v, %v", v, created)
+	}
+	if !gm.Remove(1) || gm.Has(1) {
+		t.Fatal("Remove(1) failed")
+	}
+	if keys := gm.Keys(); len(keys) != 1 || keys[0] != 2 {
+		t.Fatalf("Keys() = %v", keys)
+	}
+	for e := range gm.IterBuffered() {
+		if e.Key != 2 || e.Val != "b" {
+			t.Fatalf("IterBuffered() = %v", e)
+		}
+	}
+}
+
+func TestStringHasher(t *testing.T) {
+	cm := AdvanceNew(fnv.New32, 0)
+	cm.Set("bwm_lpd.eleyunying", 1)
+	h := fnv.New32()
+	h.Write(s)
+	if cm.GetShard("bwm_lpd.eleyunying") != cm.shards[h.Sum32()%uint32(SHARD_COUNT)] {
+		t.Fatal("string keys should keep the fnv shard layout")
+	}
+}
+
+func TestTTL(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	tm := NewMap[string, int](nil, 0)
+	tm.SetClock(clk)
+	defer tm.Close()
+	evicted := make(chan string, 2)
+	tm.OnEvict(func(key string, val int) {
+		evicted <- key
+	})
+	tm.SetWithTTL("lazy", 1, time.Millisecond)
+	tm.SetWithTTL("swept", 2, time.Millisecond)
+	tm.SetWithTTL("alive", 3, time.Hour)
+	clk.Advance(time.Millisecond - 1)
+	if _, ok := tm.Get("lazy"); !ok {
+		t.Fatal("lazy expired early")
+	}
+	clk.Advance(1)
+
+	if _, ok := tm.Get("lazy"); ok {
+		t.Fatal("lazy should have expired")
+	}
+	if k := <-evicted; k != "lazy" {
+		t.Fatalf("evicted %v, want lazy", k)
+	}
+	tm.StartJanitor(time.Minute)
+	clk.BlockUntil(1)
+	clk.Advance(time.Minute)
+	select {
+	case k := <-evicted:
+		if k != "swept" {
+			t.Fatalf("evicted %v, want swept", k)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("janitor did not sweep expired elements")
+	}
+	if !tm.Has("alive") || tm.Count() != 1 {
+		t.Fatal("alive should not expire")
+	}
+	tm.Set("alive", 4)
+	if !tm.SetIfAbsent("lazy", 5) {
+		t.Fatal("expired key should be absent")
+	}
+}
+
+func TestBounded(t *testing.T) {
+	for _, policy := range []EvictPolicy{LRU, LFU, Random} {
+		bm := NewBoundedMap[int, int](func(k int) uint32 { return 0 }, 0, 3, policy)
+		var evicted []int
+		bm.OnEvict(func(key, val int) {
+			evicted = append(evicted, key)
+		})
+		bm.Set(1, 1)
+		bm.Set(2, 2)
+		bm.Set(3, 3)
+		bm.Get(1)
+		bm.Get(1)
+		bm.Get(3)
+		bm.Get(5)
+		bm.Set(4, 4)
+		if bm.Count() != 3 || len(evicted) != 1 || evicted[0] == 4 {
+			t.Fatalf("policy %v: count %v, evicted %v", policy, bm.Count(), evicted)
+		}
+		if policy != Random && evicted[0] != 2 {
+			t.Fatalf("policy %v: evicted %v, want 2", policy, evicted)
+		}
+		if st := bm.Stats(); st.Hits != 3 || st.Misses != 1 || st.Evictions != 1 {
+			t.Fatalf("policy %v: stats %#v", policy, st)
+		}
+	}
+
+	// The capacity holds for the whole map, not per shard.
+	bm := NewBoundedMap[int, int](nil, 16, 10, LRU)
+	for i := 0; i < 1000; i += 1 {
+		bm.Set(i, i)
+		if bm.Count() > 10 {
+			t.Fatalf("%v elements, capacity 10", bm.Count())
+		}
+	}
+	// A key written to an empty shard evicts from the others.
+	sm := NewBoundedMap[int, int](func(k int) uint32 { return uint32(k) }, 4, 3, LRU)
+	for i := 0; i < 4; i += 1 {
+		sm.Set(i, i)
+	}
+	if sm.Count() != 3 || sm.Has(0) || !sm.Has(3) {
+		t.Fatalf("skewed map holds %v", sm.Items())
+	}
+}
+
+func TestGetOrLoad(t *testing.T) {
+	lm := NewMap[string, int](func(k string) uint32 { return 0 }, 0)
+	var calls int32
+	release := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			v, err := lm.GetOrLoad("slow", func() (int, error) {
+				atomic.AddInt32(&calls, 1)
+				<-release
+				return 1, nil
+			})
+			if err != nil || v != 1 {
+				t.Errorf("GetOrLoad(slow) = %v, %v", v, err)
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+	// Same shard, must not wait on the slow load.
+	lm.Set("other", 2)
+	if v, err := lm.GetOrLoad("other", nil); err != nil || v != 2 {
+		t.Fatalf("GetOrLoad(other) = %v, %v", v, err)
+	}
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Fatalf("loader called %v times", calls)
+	}
+
+	fail := errors.New("fail")
+	failing := func() (int, error) {
+		atomic.AddInt32(&calls, 1)
+		return 0, fail
+	}
+	if _, err := lm.GetOrLoad("err", failing); err != fail {
+		t.Fatalf("GetOrLoad(err) = %v", err)
+	}
+	lm.GetOrLoad("err", failing)
+	if calls != 3 || lm.Has("err") {
+		t.Fatal("errors should not be cached by default")
+	}
+	lm.CacheLoadErrors(time.Hour)
+	lm.GetOrLoad("err", failing)
+	if _, err := lm.GetOrLoad("err", failing); err != fail || calls != 4 {
+		t.Fatalf("cached error %v, calls %v", err, calls)
+	}
+	if _, err := lm.GetOrLoad("nil", nil); err != ERROR_NilLoader {
+		t.Fatalf("GetOrLoad(nil) = %v", err)
+	}
+	if _, err := lm.GetOrLoad("panic", func() (int, error) {
+		panic("boom")
+	}); !errors.Is(err, ERROR_LoaderPanicked) || lm.Has("panic") {
+		t.Fatalf("GetOrLoad(panic) = %v", err)
+	}
+
+	cm := New()
+	if v, ok := cm.GetOrBlock("a", func() map[string]interface{} {
+		return map[string]interface{}{"a": 1, "b": 2}
+	}); !ok || v != 1 || !cm.Has("b") {
+		t.Fatalf("GetOrBlock(a) = %v, %v", v, ok)
+	}
+}
+
+func TestCompute(t *testing.T) {
+	cm := NewMap[string, int](nil, 0)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cm.Upsert("counter", func(old int, exists bool) int {
+				return old + 1
+			})
+		}()
+	}
+	wg.Wait()
+	if v, _ := cm.Get("counter"); v != 100 {
+		t.Fatalf("counter = %v", v)
+	}
+	if cm.CompareAndSwap("counter", 1, 2) || !cm.CompareAndSwap("counter", 100, 0) {
+		t.Fatal("CompareAndSwap should only swap the current value")
+	}
+	if cm.RemoveIf("counter", func(v int) bool { return v > 0 }) || !cm.RemoveIf("counter", func(v int) bool { return v == 0 }) {
+		t.Fatal("RemoveIf should only remove matching values")
+	}
+	if v, ok := cm.Compute("state", func(old int, exists bool) (int, bool) {
+		return 1, !exists
+	}); !ok || v != 1 {
+		t.Fatalf("Compute(state) = %v, %v", v, ok)
+	}
+	cm.Compute("state", func(old int, exists bool) (int, bool) {
+		return old, false
+	})
+	if cm.Has("state") {
+		t.Fatal("Compute should remove the key when told not to keep it")
+	}
+}
+
+func TestRange(t *testing.T) {
+	rm := NewMap[int, int](nil, 0)
+	for i := 0; i < 100; i++ {
+		rm.Set(i, i)
+	}
+	rm.SetWithTTL(-1, -1, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+
+	visited := 0
+	rm.Range(func(k, v int) bool {
+		visited++
+		return visited < 10
+	})
+	if visited != 10 {
+		t.Fatalf("Range visited %v elements after early exit", visited)
+	}
+	if snap := rm.Snapshot(); len(snap) != 100 || snap[42] != 42 {
+		t.Fatalf("Snapshot() has %v elements", len(snap))
+	}
+	if items := rm.Items(); len(items) != 100 {
+		t.Fatalf("Items() has %v elements", len(items))
+	}
+	if v, ok := rm.Pop(42); !ok || v != 42 || rm.Has(42) {
+		t.Fatalf("Pop(42) = %v, %v", v, ok)
+	}
+
+	// Keys must not drop or block while the map grows.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 100; i < 10000; i++ {
+			rm.Set(i, i)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		if keys := rm.Keys(); len(keys) < 99 {
+			t.Fatalf("Keys() returned %v keys", len(keys))
+		}
+		for range rm.IterBuffered() {
+		}
+	}
+	<-done
+	rm.Clear()
+	if !rm.IsEmpty() {
+		t.Fatal("Clear should remove all elements")
+	}
+}
+
+func TestShardCount(t *testing.T) {
+	for _, sc := range []int{1, 7, 64, AutoShardCount()} {
+		cm := AdvanceNew(fnv.New32, sc)
+		if cm.ShardCount() != sc {
+			t.Fatalf("ShardCount() = %v, want %v", cm.ShardCount(), sc)
+		}
+		for i := 0; i < 1000; i++ {
+			cm.Set(strconv.Itoa(i), i)
+		}
+		if cm.Count() != 1000 || len(cm.Keys()) != 1000 || len(cm.Items()) != 1000 {
+			t.Fatalf("shard count %v lost elements", sc)
+		}
+	}
+}
+
+func BenchmarkShardCount(b *testing.B) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i)
+	}
+	for _, sc := range []int{1, 4, 16, 64, 256, AutoShardCount()} {
+		b.Run(strconv.Itoa(sc), func(b *testing.B) {
+			cm := AdvanceNew(fnv.New32, sc)
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					key := keys[i%len(keys)]
+					if i%4 == 0 {
+						cm.Set(key, i)
+					} else {
+						cm.Get(key)
+					}
+					i++
+				}
+			})
+		})
+	}
+}
+
+type persisted struct {
+	Name string
+}
+
+func TestPersist(t *testing.T) {
+	cm := New()
+	cm.Set("a", persisted{"a"})
+	cm.SetWithTTL("b", persisted{"b"}, time.Hour)
+	cm.SetWithTTL("c", persisted{"c"}, time.Nanosecond)
+
+	b, err := json.Marshal(cm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jm := New()
+	jm.SetValueDecoder(DecodeAs[string, persisted]())
+	if err := json.Unmarshal(b, jm); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := jm.Get("a"); v != (persisted{"a"}) || jm.Count() != 2 {
+		t.Fatalf("json round trip: %v", jm.Items())
+	}
+	var zero *ConcurrentMap
+	if err := json.Unmarshal(b, &zero); err != nil || zero.Count() != 2 {
+		t.Fatalf("json into zero map: %v", err)
+	}
+
+	gob.Register(persisted{})
+	path := filepath.Join(t.TempDir(), "map.gob")
+	if err := cm.SaveTo(path); err != nil {
+		t.Fatal(err)
+	}
+	gm := AdvanceNew(nil, 4)
+	if err := gm.LoadFrom(path); err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := gm.Get("b"); v != (persisted{"b"}) || gm.Count() != 2 {
+		t.Fatalf("gob round trip: %v", gm.Items())
+	}
+	if !gm.GetShard("b").expired("b", gm.now()+int64(2*time.Hour)) {
+		t.Fatal("ttl should survive a round trip")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	wm := New()
+	events, cancel := wm.Subscribe("watched/")
+	wm.Set("watched/a", 1)
+	wm.Set("other", 1)
+	wm.Set("watched/a", 2)
+	wm.Remove("watched/a")
+	wm.SetWithTTL("watched/b", 3, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	wm.DeleteExpired()
+
+	want := []Event[string, interface{}]{
+		{Type: EventSet, Key: "watched/a", New: 1},
+		{Type: EventSet, Key: "watched/a", Old: 1, New: 2, Existed: true},
+		{Type: EventRemove, Key: "watched/a", Old: 2, Existed: true},
+		{Type: EventSet, Key: "watched/b", New: 3},
+		{Type: EventExpire, Key: "watched/b", Old: 3, Existed: true},
+	}
+	for _, w := range want {
+		if e := <-events; e != w {
+			t.Fatalf("got %#v, want %#v", e, w)
+		}
+	}
+	cancel()
+	cancel()
+	if _, ok := <-events; ok {
+		t.Fatal("channel should be closed after cancel")
+	}
+
+	slow, cancel := wm.Watch(WatchConfig[string]{Buffer: 1})
+	defer cancel()
+	wm.Set("x", 1)
+	wm.Set("x", 2)
+	if e := <-slow; e.New != 1 || wm.DroppedEvents() != 1 {
+		t.Fatalf("slow consumer got %#v, dropped %v", e, wm.DroppedEvents())
+	}
+
+	blocked, cancelBlocked := wm.Watch(WatchConfig[string]{Policy: BlockOnFull})
+	done := make(chan struct{})
+	go func() {
+		wm.Set("y", 1)
+		close(done)
+	}()
+	if e := <-blocked; e.Key != "y" {
+		t.Fatalf("blocking consumer got %#v", e)
+	}
+	<-done
+	go wm.Set("y", 2)
+	time.Sleep(time.Millisecond)
+	cancelBlocked()
+}
+
+func TestMetrics(t *testing.T) {
+	mm := AdvanceNew(nil, 2)
+	mm.EnableMetrics()
+	mm.Set("a", 1)
+	mm.Get("a")
+	mm.Get("b")
+	mm.Remove("a")
+
+	mt := mm.Metrics()
+	var sets, gets, removes, waits int64
+	for _, sm := range mt.Shards {
+		sets += sm.Sets
+		gets += sm.Gets
+		removes += sm.Removes
+		waits += sm.LockWaits
+	}
+	if sets != 1 || gets != 2 || removes != 1 || waits < 4 || mt.Hits != 1 || mt.Misses != 1 {
+		t.Fatalf("metrics %#v", mt)
+	}
+
+	e := NewTextExporter()
+	e.Register("test", mm)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+	for _, want := range []string{
+		"# TYPE concurrentmap_items gauge\n",
+		"concurrentmap_hits_total{map=\"test\"} 1\n",
+		"concurrentmap_operations_total{map=\"test\",shard=\"1\",op=\"get\"}",
+	} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("missing %q in\n%v", want, body)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package concurrentMap
+
+import (
+	"container/heap"
+	"container/list"
+	"math/rand"
+)
+
+const (
+	LRU EvictPolicy = iota
+	LFU
+	Random
+)
+
+// Decides which element of a full shard is dropped to make room for a new one.
+type EvictPolicy int
+
+// Bookkeeping of a single shard, every call is made while the shard is held exclusively.
+type evictPolicy[K comparable] interface {
+	add(key K)
+	access(key K)
+	remove(key K)
+	victim() (K, bool)
+}
+
+func newEvictPolicy[K comparable](p EvictPolicy) evictPolicy[K] {
+	switch p {
+	case LFU:
+		return &lfuPolicy[K]{items: make(map[K]*lfuItem[K])}
+	case Random:
+		return &randomPolicy[K]{index: make(map[K]int)}
+	default:
+		return &lruPolicy[K]{order: list.New(), items: make(map[K]*list.Element)}
+	}
+}
+
+// Least recently used, the front of order is the most recent key.
+type lruPolicy[K comparable] struct {
+	order *list.List
+	items map[K]*list.Element
+}
+
+func (p *lruPolicy[K]) add(key K) {
+	if e, ok := p.items[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.items[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy[K]) access(key K) {
+	if e, ok := p.items[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy[K]) remove(key K) {
+	if e, ok := p.items[key]; ok {
+		p.order.Remove(e)
+		delete(p.items, key)
+	}
+}
+
+func (p *lruPolicy[K]) victim() (K, bool) {
+	e := p.order.Back()
+	if e == nil {
+		var zero K
+		return zero, false
+	}
+	return e.Value.(K), true
+}
+
+// Least frequently used, ties are broken by the least recent access.
+type lfuPolicy[K comparable] struct {
+	heap  lfuHeap[K]
+	items map[K]*lfuItem[K]
+	seq   uint64
+}
+
+type lfuItem[K comparable] struct {
+	key   K
+	freq  uint64
+	seq   uint64
+	index int
+}
+
+type lfuHeap[K comparable] []*lfuItem[K]
+
+func (h lfuHeap[K]) Len() int { return len(h) }
+
+func (h lfuHeap[K]) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h lfuHeap[K]) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap[K]) Push(x any) {
+	item := x.(*lfuItem[K])
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lfuHeap[K]) Pop() any {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+func (p *lfuPolicy[K]) add(key K) {
+	if _, ok := p.items[key]; ok {
+		p.access(key)
+		return
+	}
+	p.seq += 1
+	item := &lfuItem[K]{key: key, freq: 1, seq: p.seq}
+	p.items[key] = item
+	heap.Push(&p.heap, item)
+}
+
+func (p *lfuPolicy[K]) access(key K) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+	p.seq += 1
+	item.freq += 1
+	item.seq = p.seq
+	heap.Fix(&p.heap, item.index)
+}
+
+func (p *lfuPolicy[K]) remove(key K) {
+	item, ok := p.items[key]
+	if !ok {
+		return
+	}
+	heap.Remove(&p.heap, item.index)
+	delete(p.items, key)
+}
+
+func (p *lfuPolicy[K]) victim() (K, bool) {
+	if len(p.heap) == 0 {
+		var zero K
+		return zero, false
+	}
+	return p.heap[0].key, true
+}
+
+// Uniformly random, keys are kept in a slice to pick from in constant time.
+type randomPolicy[K comparable] struct {
+	keys  []K
+	index map[K]int
+}
+
+func (p *randomPolicy[K]) add(key K) {
+	if _, ok := p.index[key]; ok {
+		return
+	}
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy[K]) access(key K) {}
+
+func (p *randomPolicy[K]) remove(key K) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.index[p.keys[i]] = i
+	var zero K
+	p.keys[last] = zero
+	p.keys = p.keys[:last]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy[K]) victim() (K, bool) {
+	if len(p.keys) == 0 {
+		var zero K
+		return zero, false
+	}
+	return p.keys[rand.Intn(len(p.keys))], true
+}
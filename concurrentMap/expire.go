@@ -0,0 +1,228 @@
+package concurrentMap
+
+import (
+	"github.com/athlum/pkg/clock"
+	"sync/atomic"
+	"time"
+)
+
+func (m *Map[K, V]) now() int64 {
+	return clock.Or(m.clock).Now().UnixNano()
+}
+
+// Replaces the clock the ttls and the janitor follow, which is the wall clock by default.
+// Must be called before the map is used.
+func (m *Map[K, V]) SetClock(c clock.Clock) {
+	m.clock = c
+}
+
+// Sets the given value under the specified key, the element expires after ttl.
+// A ttl less than or equal to zero never expires, same as Set.
+func (m *Map[K, V]) SetWithTTL(key K, value V, ttl time.Duration) {
+	var deadline int64
+	if ttl > 0 {
+		deadline = m.now() + int64(ttl)
+	}
+	shard := m.GetShard(key)
+	shard.count(opSet)
+	shard.lock()
+	evicted := shard.set(key, value, deadline)
+	shard.Unlock()
+	m.evicted(evicted)
+}
+
+// Registers a callback which is called with every element that expires or is
+// evicted to stay within capacity.
+// The callback runs outside of the shard lock, so it is free to access the map.
+func (m *Map[K, V]) OnEvict(f func(key K, val V)) {
+	m.onEvict.Store(f)
+}
+
+// Sweeps expired elements shard by shard every interval until Close is called.
+func (m *Map[K, V]) StartJanitor(interval time.Duration) {
+	go m.janitor(interval)
+}
+
+func (m *Map[K, V]) janitor(interval time.Duration) {
+	t := clock.Or(m.clock).NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-m.stop.Chan():
+			return
+		case <-t.C():
+			m.DeleteExpired()
+		}
+	}
+}
+
+// Removes all expired elements from the map.
+func (m *Map[K, V]) DeleteExpired() {
+	for _, shard := range m.shards {
+		shard.lock()
+		expired := shard.sweep(m.now())
+		shard.Unlock()
+		m.expired(expired)
+	}
+}
+
+// Stops the janitor.
+func (m *Map[K, V]) Close() {
+	m.stop.Close()
+}
+
+func (m *Map[K, V]) expire(shard *MapShared[K, V], key K) {
+	shard.lock()
+	expired, _ := shard.lookupLocked(key, m.now())
+	shard.Unlock()
+	m.expired(expired)
+}
+
+func (m *Map[K, V]) expired(entries []Entry[K, V]) {
+	if len(entries) == 0 {
+		return
+	}
+	atomic.AddInt64(&m.expirations, int64(len(entries)))
+	m.notifyEvict(entries)
+}
+
+func (m *Map[K, V]) evicted(entries []Entry[K, V]) {
+	if len(entries) > 0 {
+		atomic.AddInt64(&m.evictions, int64(len(entries)))
+		m.notifyEvict(entries)
+	}
+	if m.capacity > 0 && atomic.LoadInt64(&m.size) > m.capacity {
+		m.shrink()
+	}
+}
+
+// Evicts from every shard in turn until the map is within capacity, for when the shard
+// written to had nothing left to evict.
+func (m *Map[K, V]) shrink() {
+	for _, shard := range m.shards {
+		if atomic.LoadInt64(&m.size) <= m.capacity {
+			return
+		}
+		shard.lock()
+		var entries []Entry[K, V]
+		for atomic.LoadInt64(&m.size) > m.capacity {
+			victim, ok := shard.policy.victim()
+			if !ok {
+				break
+			}
+			entries = append(entries, Entry[K, V]{victim, shard.items[victim]})
+			shard.remove(victim, EventEvict)
+		}
+		shard.Unlock()
+		if len(entries) > 0 {
+			atomic.AddInt64(&m.evictions, int64(len(entries)))
+			m.notifyEvict(entries)
+		}
+	}
+}
+
+func (m *Map[K, V]) notifyEvict(entries []Entry[K, V]) {
+	f, _ := m.onEvict.Load().(func(K, V))
+	if f == nil {
+		return
+	}
+	for _, e := range entries {
+		f(e.Key, e.Val)
+	}
+}
+
+// Stores an element, must be called with the write lock held.
+// Elements evicted to make room for a new key are returned.
+func (s *MapShared[K, V]) set(key K, value V, deadline int64) []Entry[K, V] {
+	var evicted []Entry[K, V]
+	old, exists := s.items[key]
+	if s.policy != nil && !exists {
+		evicted = s.evict(evicted)
+		atomic.AddInt64(s.size, 1)
+	}
+	s.items[key] = value
+	if deadline > 0 {
+		s.expires[key] = deadline
+	} else {
+		delete(s.expires, key)
+	}
+	if s.policy != nil {
+		if exists {
+			s.policy.access(key)
+		} else {
+			s.policy.add(key)
+		}
+	}
+	s.hub.emit(Event[K, V]{Type: EventSet, Key: key, Old: old, New: value, Existed: exists})
+	return evicted
+}
+
+// Evicts elements of the shard while the map is full, must be called with the write lock held.
+func (s *MapShared[K, V]) evict(evicted []Entry[K, V]) []Entry[K, V] {
+	for atomic.LoadInt64(s.size) >= s.capacity {
+		victim, ok := s.policy.victim()
+		if !ok {
+			break
+		}
+		evicted = append(evicted, Entry[K, V]{victim, s.items[victim]})
+		s.remove(victim, EventEvict)
+	}
+	return evicted
+}
+
+// Drops an element, must be called with the write lock held.
+// Watchers are told the element is gone for reason.
+func (s *MapShared[K, V]) remove(key K, reason EventType) {
+	old, ok := s.items[key]
+	if !ok {
+		return
+	}
+	delete(s.items, key)
+	delete(s.expires, key)
+	if s.policy != nil {
+		s.policy.remove(key)
+		atomic.AddInt64(s.size, -1)
+	}
+	s.hub.emit(Event[K, V]{Type: reason, Key: key, Old: old, Existed: true})
+}
+
+// Records a read hit, must be called with the read lock held.
+func (s *MapShared[K, V]) access(key K) {
+	if s.policy == nil {
+		return
+	}
+	s.plock.Lock()
+	s.policy.access(key)
+	s.plock.Unlock()
+}
+
+func (s *MapShared[K, V]) expired(key K, now int64) bool {
+	deadline, ok := s.expires[key]
+	return ok && deadline <= now
+}
+
+// Reports whether a live element is stored under key, an expired element is
+// removed and returned. Must be called with the write lock held.
+func (s *MapShared[K, V]) lookupLocked(key K, now int64) ([]Entry[K, V], bool) {
+	val, ok := s.items[key]
+	if !ok {
+		return nil, false
+	}
+	if s.expired(key, now) {
+		s.remove(key, EventExpire)
+		return []Entry[K, V]{{key, val}}, false
+	}
+	return nil, true
+}
+
+// Removes every expired element, must be called with the write lock held.
+func (s *MapShared[K, V]) sweep(now int64) []Entry[K, V] {
+	var expired []Entry[K, V]
+	for key, deadline := range s.expires {
+		if deadline <= now {
+			expired = append(expired, Entry[K, V]{key, s.items[key]})
+			s.remove(key, EventExpire)
+		}
+	}
+	return expired
+}
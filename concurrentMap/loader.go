@@ -0,0 +1,112 @@
+package concurrentMap
+
+import (
+	"github.com/pkg/errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ERROR_LoaderPanicked = errors.New("loader panicked.")
+	ERROR_NilLoader      = errors.New("nil loader.")
+	ERROR_NotLoaded      = errors.New("key not loaded.")
+)
+
+// An in-flight load shared by every caller of the same key.
+type loadCall[V any] struct {
+	done chan struct{}
+	val  V
+	err  error
+}
+
+type loadError struct {
+	err      error
+	deadline int64
+}
+
+// Keeps loader errors for ttl, so GetOrLoad returns them without calling the loader again.
+// A ttl less than or equal to zero disables caching, which is the default.
+func (m *Map[K, V]) CacheLoadErrors(ttl time.Duration) {
+	atomic.StoreInt64(&m.loadErrTTL, int64(ttl))
+}
+
+// Retrieves an element from map under given key, calls loader to produce it if absent.
+// Concurrent callers of the same key wait on a single load, the shard is not locked
+// while the loader runs. A value set by someone else during the load wins over the loaded one.
+// A loader which panics fails the load with ERROR_LoaderPanicked for every caller.
+func (m *Map[K, V]) GetOrLoad(key K, loader func() (V, error)) (V, error) {
+	if val, ok := m.Get(key); ok {
+		return val, nil
+	}
+	shard := m.GetShard(key)
+	shard.lock()
+	expired, ok := shard.lookupLocked(key, m.now())
+	if ok {
+		val := shard.items[key]
+		shard.Unlock()
+		return val, nil
+	}
+	if le, ok := shard.loadErrs[key]; ok {
+		if le.deadline > m.now() {
+			shard.Unlock()
+			m.expired(expired)
+			var zero V
+			return zero, le.err
+		}
+		delete(shard.loadErrs, key)
+	}
+	if c, ok := shard.loads[key]; ok {
+		shard.Unlock()
+		m.expired(expired)
+		<-c.done
+		return c.val, c.err
+	}
+	if loader == nil {
+		shard.Unlock()
+		m.expired(expired)
+		var zero V
+		return zero, ERROR_NilLoader
+	}
+	c := &loadCall[V]{done: make(chan struct{})}
+	if shard.loads == nil {
+		shard.loads = make(map[K]*loadCall[V])
+	}
+	shard.loads[key] = c
+	shard.Unlock()
+	m.expired(expired)
+
+	m.load(shard, key, c, loader)
+	return c.val, c.err
+}
+
+func (m *Map[K, V]) load(shard *MapShared[K, V], key K, c *loadCall[V], loader func() (V, error)) {
+	defer func() {
+		var expired, evicted []Entry[K, V]
+		shard.lock()
+		delete(shard.loads, key)
+		if c.err == nil {
+			var ok bool
+			if expired, ok = shard.lookupLocked(key, m.now()); ok {
+				c.val = shard.items[key]
+			} else {
+				evicted = shard.set(key, c.val, 0)
+			}
+		} else if ttl := atomic.LoadInt64(&m.loadErrTTL); ttl > 0 {
+			if shard.loadErrs == nil {
+				shard.loadErrs = make(map[K]loadError)
+			}
+			shard.loadErrs[key] = loadError{err: c.err, deadline: m.now() + ttl}
+		}
+		shard.Unlock()
+		m.expired(expired)
+		m.evicted(evicted)
+		close(c.done)
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			var zero V
+			c.val, c.err = zero, errors.Wrapf(ERROR_LoaderPanicked, "%v", r)
+		}
+	}()
+	c.val, c.err = loader()
+}
@@ -0,0 +1,204 @@
+package concurrentMap
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	opGet = iota
+	opSet
+	opRemove
+	opCount
+)
+
+var opNames = [opCount]string{"get", "set", "remove"}
+
+// Instrumentation of a single shard, only collected after EnableMetrics.
+type shardMetrics struct {
+	lockWaits    int64
+	lockWaitTime int64
+	ops          [opCount]int64
+}
+
+type ShardMetrics struct {
+	Items        int
+	LockWaits    int64
+	LockWaitTime time.Duration
+	Gets         int64
+	Sets         int64
+	Removes      int64
+}
+
+type Metrics struct {
+	Stats
+	Shards []ShardMetrics
+}
+
+// Starts collecting lock wait time and operation counters of every shard.
+// It costs two clock reads per lock, so it is off by default.
+func (m *Map[K, V]) EnableMetrics() {
+	for _, shard := range m.shards {
+		shard.metrics.CompareAndSwap(nil, &shardMetrics{})
+	}
+}
+
+// Returns a snapshot of the counters and the number of items of every shard.
+func (m *Map[K, V]) Metrics() Metrics {
+	mt := Metrics{
+		Stats:  m.Stats(),
+		Shards: make([]ShardMetrics, len(m.shards)),
+	}
+	for i, shard := range m.shards {
+		shard.RLock()
+		mt.Shards[i].Items = len(shard.items)
+		shard.RUnlock()
+		if sm := shard.metrics.Load(); sm != nil {
+			mt.Shards[i].LockWaits = atomic.LoadInt64(&sm.lockWaits)
+			mt.Shards[i].LockWaitTime = time.Duration(atomic.LoadInt64(&sm.lockWaitTime))
+			mt.Shards[i].Gets = atomic.LoadInt64(&sm.ops[opGet])
+			mt.Shards[i].Sets = atomic.LoadInt64(&sm.ops[opSet])
+			mt.Shards[i].Removes = atomic.LoadInt64(&sm.ops[opRemove])
+		}
+	}
+	return mt
+}
+
+func (s *MapShared[K, V]) lock() {
+	sm := s.metrics.Load()
+	if sm == nil {
+		s.Lock()
+		return
+	}
+	start := time.Now()
+	s.Lock()
+	sm.waited(time.Since(start))
+}
+
+func (s *MapShared[K, V]) rlock() {
+	sm := s.metrics.Load()
+	if sm == nil {
+		s.RLock()
+		return
+	}
+	start := time.Now()
+	s.RLock()
+	sm.waited(time.Since(start))
+}
+
+func (s *MapShared[K, V]) count(op int) {
+	if sm := s.metrics.Load(); sm != nil {
+		atomic.AddInt64(&sm.ops[op], 1)
+	}
+}
+
+func (sm *shardMetrics) waited(d time.Duration) {
+	atomic.AddInt64(&sm.lockWaits, 1)
+	atomic.AddInt64(&sm.lockWaitTime, int64(d))
+}
+
+// Anything which reports Metrics, every Map does.
+type MetricsSource interface {
+	Metrics() Metrics
+}
+
+// Writes the metrics of the registered sources to w.
+type Exporter interface {
+	Register(name string, src MetricsSource)
+	Export(w io.Writer) error
+}
+
+// An Exporter in the Prometheus text exposition format, it could be served as an http.Handler.
+type TextExporter struct {
+	lock    sync.RWMutex
+	sources map[string]MetricsSource
+}
+
+func NewTextExporter() *TextExporter {
+	return &TextExporter{sources: make(map[string]MetricsSource)}
+}
+
+// Registers src under name, which is exported as the map label.
+func (e *TextExporter) Register(name string, src MetricsSource) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.sources[name] = src
+}
+
+func (e *TextExporter) Unregister(name string) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	delete(e.sources, name)
+}
+
+type metricFamily struct {
+	name  string
+	kind  string
+	help  string
+	lines []string
+}
+
+func (e *TextExporter) Export(w io.Writer) error {
+	e.lock.RLock()
+	names := make([]string, 0, len(e.sources))
+	for name := range e.sources {
+		names = append(names, name)
+	}
+	sources := make([]MetricsSource, 0, len(names))
+	sort.Strings(names)
+	for _, name := range names {
+		sources = append(sources, e.sources[name])
+	}
+	e.lock.RUnlock()
+
+	families := []*metricFamily{
+		{name: "concurrentmap_hits_total", kind: "counter", help: "Number of Get calls which found the key."},
+		{name: "concurrentmap_misses_total", kind: "counter", help: "Number of Get calls which missed the key."},
+		{name: "concurrentmap_evictions_total", kind: "counter", help: "Number of items evicted to stay within capacity."},
+		{name: "concurrentmap_expirations_total", kind: "counter", help: "Number of items removed after their ttl."},
+		{name: "concurrentmap_items", kind: "gauge", help: "Number of items per shard."},
+		{name: "concurrentmap_lock_waits_total", kind: "counter", help: "Number of shard lock acquisitions."},
+		{name: "concurrentmap_lock_wait_seconds_total", kind: "counter", help: "Time spent waiting for shard locks."},
+		{name: "concurrentmap_operations_total", kind: "counter", help: "Number of operations per shard."},
+	}
+	for i, src := range sources {
+		mt := src.Metrics()
+		label := "map=" + strconv.Quote(names[i])
+		for j, v := range []int64{mt.Hits, mt.Misses, mt.Evictions, mt.Expirations} {
+			families[j].lines = append(families[j].lines, fmt.Sprintf("{%v} %v", label, v))
+		}
+		for shard, sm := range mt.Shards {
+			sl := fmt.Sprintf("%v,shard=\"%v\"", label, shard)
+			families[4].lines = append(families[4].lines, fmt.Sprintf("{%v} %v", sl, sm.Items))
+			families[5].lines = append(families[5].lines, fmt.Sprintf("{%v} %v", sl, sm.LockWaits))
+			families[6].lines = append(families[6].lines, fmt.Sprintf("{%v} %v", sl, sm.LockWaitTime.Seconds()))
+			for op, v := range []int64{sm.Gets, sm.Sets, sm.Removes} {
+				families[7].lines = append(families[7].lines, fmt.Sprintf("{%v,op=\"%v\"} %v", sl, opNames[op], v))
+			}
+		}
+	}
+	for _, f := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %v %v\n# TYPE %v %v\n", f.name, f.help, f.name, f.kind); err != nil {
+			return err
+		}
+		for _, l := range f.lines {
+			if _, err := fmt.Fprintf(w, "%v%v\n", f.name, l); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (e *TextExporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := e.Export(w); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
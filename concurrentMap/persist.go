@@ -0,0 +1,156 @@
+package concurrentMap
+
+import (
+	"bufio"
+	"encoding/gob"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Decodes a JSON value stored under key, used by UnmarshalJSON.
+type ValueDecoder[K comparable, V any] func(key K, raw json.RawMessage) (V, error)
+
+// Returns a ValueDecoder which decodes every value as T, for maps of interface{} values.
+func DecodeAs[K comparable, T any]() ValueDecoder[K, interface{}] {
+	return func(key K, raw json.RawMessage) (interface{}, error) {
+		var v T
+		if err := json.Unmarshal(raw, &v); err != nil {
+			return nil, err
+		}
+		return v, nil
+	}
+}
+
+// Sets the decoder used by UnmarshalJSON, values are decoded by encoding/json if unset.
+func (m *Map[K, V]) SetValueDecoder(dec ValueDecoder[K, V]) {
+	m.decoder.Store(dec)
+}
+
+// Encodes the live elements as a JSON object.
+func (m *Map[K, V]) MarshalJSON() ([]byte, error) {
+	return json.Marshal(m.Items())
+}
+
+// Decodes a JSON object into the map, existing elements are kept unless overwritten.
+func (m *Map[K, V]) UnmarshalJSON(b []byte) error {
+	m.init()
+	dec, _ := m.decoder.Load().(ValueDecoder[K, V])
+	if dec == nil {
+		data := make(map[K]V)
+		if err := json.Unmarshal(b, &data); err != nil {
+			return err
+		}
+		m.MSet(data)
+		return nil
+	}
+	raw := make(map[K]json.RawMessage)
+	if err := json.Unmarshal(b, &raw); err != nil {
+		return err
+	}
+	data := make(map[K]V, len(raw))
+	for key, r := range raw {
+		val, err := dec(key, r)
+		if err != nil {
+			return errors.Wrapf(err, "failed to decode value of %v:", key)
+		}
+		data[key] = val
+	}
+	m.MSet(data)
+	return nil
+}
+
+type gobEntry[K comparable, V any] struct {
+	Key      K
+	Val      V
+	Deadline int64
+}
+
+// Streams the live elements to w in gob format, one shard at a time.
+// Concrete types stored in interface values must be registered with gob.Register.
+func (m *Map[K, V]) EncodeGob(w io.Writer) error {
+	enc := gob.NewEncoder(w)
+	for _, shard := range m.shards {
+		ts := m.now()
+		shard.rlock()
+		entries := make([]gobEntry[K, V], 0, len(shard.items))
+		for key, val := range shard.items {
+			if !shard.expired(key, ts) {
+				entries = append(entries, gobEntry[K, V]{key, val, shard.expires[key]})
+			}
+		}
+		shard.RUnlock()
+		if len(entries) == 0 {
+			continue
+		}
+		if err := enc.Encode(entries); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reads elements written by EncodeGob from r into the map, ttls are kept
+// and elements which expired in the meantime are skipped.
+func (m *Map[K, V]) DecodeGob(r io.Reader) error {
+	m.init()
+	dec := gob.NewDecoder(r)
+	for {
+		var entries []gobEntry[K, V]
+		if err := dec.Decode(&entries); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		ts := m.now()
+		for _, e := range entries {
+			if e.Deadline > 0 && e.Deadline <= ts {
+				continue
+			}
+			shard := m.GetShard(e.Key)
+			shard.lock()
+			evicted := shard.set(e.Key, e.Val, e.Deadline)
+			shard.Unlock()
+			m.evicted(evicted)
+		}
+	}
+}
+
+// Writes the map to path in gob format. The file is written to a temp file
+// in the same directory first and renamed, so path is never left half written.
+func (m *Map[K, V]) SaveTo(path string) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return errors.Wrap(err, "failed to create temp file:")
+	}
+	tmp := f.Name()
+	w := bufio.NewWriter(f)
+	if err = m.EncodeGob(w); err == nil {
+		if err = w.Flush(); err == nil {
+			err = f.Sync()
+		}
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return errors.Wrap(err, "failed to save map:")
+	}
+	return nil
+}
+
+// Reads a map written by SaveTo from path.
+func (m *Map[K, V]) LoadFrom(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return m.DecodeGob(bufio.NewReader(f))
+}
@@ -0,0 +1,24 @@
+package concurrentMap
+
+import (
+	"runtime"
+)
+
+// Scales the shard count with GOMAXPROCS.
+const shardsPerProc = 4
+
+// Returns a shard count sized for the current GOMAXPROCS: the next power of two
+// of shardsPerProc shards per processor, never less than SHARD_COUNT.
+// It's a heuristic rather than a measured optimum, so it's opt-in: pass it to NewMap
+// where BenchmarkShardCount shows it helps on the target hardware.
+func AutoShardCount() int {
+	n := runtime.GOMAXPROCS(0) * shardsPerProc
+	sc := 1
+	for sc < n {
+		sc <<= 1
+	}
+	if sc < SHARD_COUNT {
+		sc = SHARD_COUNT
+	}
+	return sc
+}
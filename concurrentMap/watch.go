@@ -0,0 +1,178 @@
+package concurrentMap
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	EventSet EventType = iota
+	EventRemove
+	EventExpire
+	EventEvict
+)
+
+const (
+	DropEvents  SlowConsumerPolicy = iota // Events are dropped while the buffer is full.
+	BlockOnFull                           // Writers wait for the consumer, holding the shard lock.
+)
+
+const DefaultWatchBuffer = 64
+
+type EventType int
+
+// Decides what happens to an event when a watcher's buffer is full.
+type SlowConsumerPolicy int
+
+// A change of a single element. Old is set if Existed, New is set for EventSet.
+type Event[K comparable, V any] struct {
+	Type    EventType
+	Key     K
+	Old     V
+	New     V
+	Existed bool
+}
+
+type WatchConfig[K comparable] struct {
+	Filter func(key K) bool // Every key is watched if nil.
+	Buffer int
+	Policy SlowConsumerPolicy
+}
+
+// Returns a channel of the changes to keys starting with prefix, and a func to stop watching.
+// Keys which are not strings are matched by their fmt representation.
+// Events are dropped when the consumer falls DefaultWatchBuffer events behind.
+func (m *Map[K, V]) Subscribe(prefix string) (<-chan Event[K, V], func()) {
+	var filter func(key K) bool
+	if prefix != "" {
+		filter = func(key K) bool {
+			if s, ok := any(key).(string); ok {
+				return strings.HasPrefix(s, prefix)
+			}
+			return strings.HasPrefix(fmt.Sprint(key), prefix)
+		}
+	}
+	return m.Watch(WatchConfig[K]{Filter: filter, Buffer: DefaultWatchBuffer})
+}
+
+// Returns a channel of the changes to keys accepted by cfg.Filter, and a func to stop watching.
+// Events of the same key are delivered in order. The channel is closed after cancel.
+// With BlockOnFull, the consumer must not write to the map while it is behind.
+func (m *Map[K, V]) Watch(cfg WatchConfig[K]) (<-chan Event[K, V], func()) {
+	if cfg.Buffer < 0 {
+		cfg.Buffer = 0
+	}
+	w := &watcher[K, V]{
+		filter: cfg.Filter,
+		policy: cfg.Policy,
+		ch:     make(chan Event[K, V], cfg.Buffer),
+		done:   make(chan struct{}),
+	}
+	m.hub.add(w)
+	return w.ch, func() {
+		m.hub.remove(w)
+		w.close()
+	}
+}
+
+// Returns the number of events dropped by DropEvents watchers.
+func (m *Map[K, V]) DroppedEvents() int64 {
+	return atomic.LoadInt64(&m.hub.dropped)
+}
+
+type watcher[K comparable, V any] struct {
+	filter func(key K) bool
+	policy SlowConsumerPolicy
+	ch     chan Event[K, V]
+	done   chan struct{}
+	once   sync.Once
+	lock   sync.RWMutex // Guards ch against being closed while sending.
+	closed bool
+}
+
+func (w *watcher[K, V]) send(e Event[K, V]) bool {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	if w.closed {
+		return true
+	}
+	if w.policy == BlockOnFull {
+		select {
+		case w.ch <- e:
+		case <-w.done:
+		}
+		return true
+	}
+	select {
+	case w.ch <- e:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *watcher[K, V]) close() {
+	w.once.Do(func() {
+		close(w.done)
+		w.lock.Lock()
+		w.closed = true
+		close(w.ch)
+		w.lock.Unlock()
+	})
+}
+
+// Watchers of a map, shared by its shards. The list is copied on write,
+// so emitting only costs an atomic load while nobody is watching.
+type watchHub[K comparable, V any] struct {
+	lock     sync.Mutex
+	watchers atomic.Pointer[[]*watcher[K, V]]
+	dropped  int64
+}
+
+func (h *watchHub[K, V]) add(w *watcher[K, V]) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	var ws []*watcher[K, V]
+	if old := h.watchers.Load(); old != nil {
+		ws = append(ws, *old...)
+	}
+	ws = append(ws, w)
+	h.watchers.Store(&ws)
+}
+
+func (h *watchHub[K, V]) remove(w *watcher[K, V]) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	old := h.watchers.Load()
+	if old == nil {
+		return
+	}
+	ws := make([]*watcher[K, V], 0, len(*old))
+	for _, o := range *old {
+		if o != w {
+			ws = append(ws, o)
+		}
+	}
+	h.watchers.Store(&ws)
+}
+
+// Delivers e to every interested watcher, called with the shard write lock held.
+func (h *watchHub[K, V]) emit(e Event[K, V]) {
+	if h == nil {
+		return
+	}
+	ws := h.watchers.Load()
+	if ws == nil {
+		return
+	}
+	for _, w := range *ws {
+		if w.filter != nil && !w.filter(e.Key) {
+			continue
+		}
+		if !w.send(e) {
+			atomic.AddInt64(&h.dropped, 1)
+		}
+	}
+}
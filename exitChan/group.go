@@ -0,0 +1,231 @@
+package exitChan
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+var (
+	ERROR_StopTimeout = errors.New("stop timed out.")
+)
+
+type stopHook struct {
+	name    string
+	timeout time.Duration
+	f       func(ctx context.Context) error
+}
+
+// Runs the hook, giving up after its timeout if it has one.
+func (h stopHook) run(ctx context.Context) error {
+	if h.timeout <= 0 {
+		return h.f(ctx)
+	}
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- h.f(ctx)
+	}()
+	select {
+	case err := <-errc:
+		return err
+	case <-ctx.Done():
+		return ERROR_StopTimeout
+	}
+}
+
+// A component in a tree which stops in order. Once closed, a group stops its children
+// one by one, latest first, then waits for the goroutines started with Go, then runs
+// its stop hooks, latest first. Closing a child doesn't affect its parent.
+type Group struct {
+	exit   *ExitChan
+	parent *Group
+	ctx    context.Context
+	cancel context.CancelFunc
+	once   sync.Once
+	done   chan struct{}
+	wg     sync.WaitGroup
+
+	// Guarded by lock.
+	lock     sync.Mutex
+	release  func() bool // Unregisters from the context the group follows.
+	children []*Group
+	hooks    []stopHook
+	err      error
+}
+
+func newGroup(ctx context.Context) *Group {
+	g := &Group{
+		exit: NewExitChan(),
+		done: make(chan struct{}),
+	}
+	g.ctx, g.cancel = context.WithCancel(ctx)
+	return g
+}
+
+func NewGroup() *Group {
+	return newGroup(context.Background())
+}
+
+// Returns a group which is closed once ctx is done, its Context carries the values of ctx.
+func WithContext(ctx context.Context) *Group {
+	g := newGroup(context.WithoutCancel(ctx))
+	// Held so a ctx done already can't stop the group before release is set.
+	g.lock.Lock()
+	g.release = context.AfterFunc(ctx, g.Close)
+	g.lock.Unlock()
+	return g
+}
+
+// Returns a group stopped along with g, before the hooks of g run.
+// The child of a closed group is closed right away.
+func (g *Group) Child() *Group {
+	c := newGroup(context.WithoutCancel(g.ctx))
+	c.parent = g
+	g.lock.Lock()
+	if g.exit.Exited() {
+		g.lock.Unlock()
+		c.Close()
+		return c
+	}
+	g.children = append(g.children, c)
+	g.lock.Unlock()
+	return c
+}
+
+func (g *Group) removeChild(c *Group) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	// Copied rather than filtered in place, shutdown may be going through the old slice.
+	children := make([]*Group, 0, len(g.children))
+	for _, child := range g.children {
+		if child != c {
+			children = append(children, child)
+		}
+	}
+	g.children = children
+}
+
+// Registers f to run when the group stops, f is given up after timeout unless it is 0.
+// f runs right away if the group is closed already.
+func (g *Group) OnStop(name string, timeout time.Duration, f func(ctx context.Context) error) {
+	h := stopHook{name, timeout, f}
+	g.lock.Lock()
+	if g.exit.Exited() {
+		g.lock.Unlock()
+		if err := h.run(context.WithoutCancel(g.ctx)); err != nil {
+			g.fail(errors.Wrap(err, name))
+		}
+		return
+	}
+	g.hooks = append(g.hooks, h)
+	g.lock.Unlock()
+}
+
+// Runs f in a goroutine the group waits for when it stops, f should return once Chan is closed.
+// Returns false without running f if the group is closed already.
+func (g *Group) Go(f func()) bool {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.exit.Exited() {
+		return false
+	}
+	g.wg.Add(1)
+	go func() {
+		defer g.wg.Done()
+		f()
+	}()
+	return true
+}
+
+// Starts stopping the group, it's safe to call more than once. Use Wait for the stop to complete.
+func (g *Group) Close() {
+	g.once.Do(func() {
+		g.lock.Lock()
+		g.exit.Close()
+		g.lock.Unlock()
+		g.cancel()
+		go g.shutdown()
+	})
+}
+
+func (g *Group) shutdown() {
+	defer close(g.done)
+	// Neither children nor hooks are added once closed.
+	g.lock.Lock()
+	release, children, hooks := g.release, g.children, g.hooks
+	g.lock.Unlock()
+	if release != nil {
+		release()
+	}
+	for i := len(children) - 1; i >= 0; i -= 1 {
+		children[i].Close()
+		if err := children[i].Wait(); err != nil {
+			g.fail(err)
+		}
+	}
+	g.wg.Wait()
+	ctx := context.WithoutCancel(g.ctx)
+	for i := len(hooks) - 1; i >= 0; i -= 1 {
+		if err := hooks[i].run(ctx); err != nil {
+			g.fail(errors.Wrap(err, hooks[i].name))
+		}
+	}
+	if g.parent != nil {
+		g.parent.removeChild(g)
+	}
+}
+
+// Keeps the first error of the stop.
+func (g *Group) fail(err error) {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	if g.err == nil {
+		g.err = err
+	}
+}
+
+// Blocks until the group stopped, returns the first error of its children or hooks.
+func (g *Group) Wait() error {
+	<-g.done
+	g.lock.Lock()
+	defer g.lock.Unlock()
+	return g.err
+}
+
+// Closes the group and waits for it to stop, for at most timeout unless it is 0.
+func (g *Group) Shutdown(timeout time.Duration) error {
+	g.Close()
+	if timeout <= 0 {
+		return g.Wait()
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case <-g.done:
+		return g.Wait()
+	case <-t.C:
+		return ERROR_StopTimeout
+	}
+}
+
+// Returns a channel which is closed once the group starts stopping.
+func (g *Group) Chan() <-chan struct{} {
+	return g.exit.Chan()
+}
+
+func (g *Group) Exited() bool {
+	return g.exit.Exited()
+}
+
+// Returns a channel which is closed once the group stopped.
+func (g *Group) Done() <-chan struct{} {
+	return g.done
+}
+
+// Returns a context which is cancelled once the group starts stopping.
+func (g *Group) Context() context.Context {
+	return g.ctx
+}
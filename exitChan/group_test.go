@@ -0,0 +1,111 @@
+package exitChan
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGroup(t *testing.T) {
+	var lock sync.Mutex
+	var order []string
+	record := func(name string) func(context.Context) error {
+		return func(context.Context) error {
+			lock.Lock()
+			defer lock.Unlock()
+			order = append(order, name)
+			return nil
+		}
+	}
+
+	root := NewGroup()
+	root.OnStop("root", 0, record("root"))
+	db := root.Child()
+	db.OnStop("db", 0, record("db"))
+	server := root.Child()
+	server.OnStop("server", 0, record("server"))
+	handler := server.Child()
+	handler.OnStop("handler", 0, record("handler"))
+	server.Go(func() {
+		<-server.Chan()
+		// Children stop before the goroutines are waited for.
+		<-handler.Done()
+		record("worker")(nil)
+	})
+	server.OnStop("listener", 0, record("listener"))
+
+	// Closing a child doesn't stop its parent.
+	cache := root.Child()
+	cache.OnStop("cache", 0, record("cache"))
+	if err := cache.Shutdown(0); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if root.Exited() {
+		t.Fatal("closing a child closed its parent")
+	}
+
+	if err := root.Shutdown(time.Second); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if s := strings.Join(order, ","); s != "cache,handler,worker,listener,server,db,root" {
+		t.Fatalf("stopped in order %v", s)
+	}
+	if root.Context().Err() == nil || handler.Context().Err() == nil {
+		t.Fatal("contexts should be cancelled once stopped")
+	}
+	if root.Go(func() {}) {
+		t.Fatal("Go() should fail on a stopped group")
+	}
+	if c := root.Child(); !c.Exited() {
+		t.Fatal("the child of a stopped group should be closed")
+	}
+}
+
+func TestGroupTimeout(t *testing.T) {
+	g := NewGroup()
+	failed := errors.New("failed")
+	g.OnStop("failing", 0, func(context.Context) error {
+		return failed
+	})
+	g.OnStop("stuck", time.Millisecond*10, func(ctx context.Context) error {
+		<-ctx.Done()
+		time.Sleep(time.Millisecond * 10)
+		return nil
+	})
+	if err := g.Shutdown(0); errors.Cause(err) != ERROR_StopTimeout {
+		t.Fatalf("Shutdown() = %v, the stuck hook should time out first", err)
+	}
+
+	g = NewGroup()
+	g.OnStop("slow", 0, func(context.Context) error {
+		time.Sleep(time.Millisecond * 50)
+		return nil
+	})
+	if err := g.Shutdown(time.Millisecond); err != ERROR_StopTimeout {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatalf("Wait() = %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), "key", "value"))
+	g = WithContext(ctx)
+	if g.Context().Value("key") != "value" {
+		t.Fatal("the context values should be kept")
+	}
+	cancel()
+	select {
+	case <-g.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the group should stop with its context")
+	}
+
+	// A context done already stops the group right away.
+	g = WithContext(ctx)
+	if err := g.Wait(); err != nil || !g.Exited() {
+		t.Fatalf("Wait() = %v, the group should stop with a cancelled context", err)
+	}
+}
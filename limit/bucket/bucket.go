@@ -1,103 +1,268 @@
 package limitBucket
 
 import (
+	"context"
+	"github.com/athlum/pkg/clock"
 	"github.com/athlum/pkg/exitChan"
-	"github.com/athlum/pkg/nextTicket"
-	"github.com/athlum/pkg/utils"
+	"github.com/athlum/pkg/log"
+	"github.com/pkg/errors"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+var (
+	ERROR_Closed       = errors.New("limit bucket closed.")
+	ERROR_ExceedsLimit = errors.New("acquire exceeds burst.")
+	ERROR_InvalidCount = errors.New("acquire count must be positive.")
+)
+
+// A token bucket refilled lazily from the time elapsed since it was last touched,
+// no goroutine runs unless Chan is used.
 type Engine struct {
-	lock  *sync.Mutex
-	ch    chan int
-	stock chan int
-	next  *Config
-	stop  *exitChan.ExitChan
+	clock   clock.Clock
+	lock    *sync.Mutex
+	ch      chan int
+	stop    *exitChan.Group // Runs the pump and the stats log, ch is closed once they are done.
+	pump    *sync.Once
+	waiters int64
+
+	// Guarded by lock. Tokens turn negative while tokens not yet refilled are reserved.
+	cfg       Config
+	tokens    float64
+	rate      float64
+	burst     float64
+	last      time.Time
+	restocked time.Time // The last advance which added tokens.
+	issued    int64
+	dropped   float64
+}
+
+// A snapshot of the counters of an Engine.
+type Stats struct {
+	Config      Config
+	Tokens      float64   // Available right now, negative while tokens not yet refilled are reserved.
+	Issued      int64     // Tokens handed out, reservations given up are not counted.
+	Dropped     int64     // Tokens refilled over Burst, the capacity nobody used.
+	Waiters     int       // Callers blocked in Wait.
+	LastRestock time.Time // Last time tokens were added, a full bucket isn't refilled.
 }
 
 func New(cfg *Config) (*Engine, error) {
-	cfg.changed = true
+	return NewWithClock(cfg, clock.Real)
+}
+
+// Same as New, with the refills and waits driven by clk.
+func NewWithClock(cfg *Config, clk clock.Clock) (*Engine, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	clk = clock.Or(clk)
 	e := &Engine{
+		clock: clk,
 		lock:  &sync.Mutex{},
 		ch:    make(chan int),
-		stock: make(chan int),
-		stop:  exitChan.NewExitChan(),
-		next:  cfg,
+		stop:  exitChan.NewGroup(),
+		pump:  &sync.Once{},
+		last:  clk.Now(),
 	}
-	t, err := nextTicket.NewTicket(utils.Duration(e.next.Interval))
-	if err != nil {
-		return nil, err
-	}
-	go e.stockLoop()
-	go e.loop(t)
+	e.restocked = e.last
+	e.stop.OnStop("chan", 0, func(context.Context) error {
+		close(e.ch)
+		return nil
+	})
+	e.apply(cfg)
+	e.tokens = e.burst
 	return e, nil
 }
 
-func (e *Engine) loop(t *nextTicket.Ticket) {
-	e.stock <- e.next.Limit
-	defer t.Stop()
-	for {
-		select {
-		case <-e.stop.Chan():
-			return
-		case <-t.C:
-			e.restock(t)
+// Must be called with lock held.
+func (e *Engine) apply(cfg *Config) {
+	e.cfg = cfg.as(TokenBucket)
+	e.rate = cfg.Rate()
+	e.burst = float64(cfg.burst())
+	if e.tokens > e.burst {
+		e.tokens = e.burst
+	}
+}
+
+// Refills the tokens earned since last, must be called with lock held.
+func (e *Engine) advance(now time.Time) {
+	if elapsed := now.Sub(e.last); elapsed > 0 {
+		if e.tokens < e.burst {
+			e.restocked = now
 		}
+		e.tokens += elapsed.Seconds() * e.rate
+		if e.tokens > e.burst {
+			e.dropped += e.tokens - e.burst
+			e.tokens = e.burst
+		}
+		e.last = now
 	}
 }
 
-func (e *Engine) lockedNext() (Config, bool) {
+// Takes n tokens if they are available right now.
+func (e *Engine) TryAcquire(n int) bool {
 	e.lock.Lock()
 	defer e.lock.Unlock()
-	changed := e.next.changed
-	if changed {
-		e.next.changed = false
+	if e.stop.Exited() || n <= 0 {
+		return false
+	}
+	e.advance(e.clock.Now())
+	if e.tokens < float64(n) {
+		return false
 	}
-	return *e.next, changed
+	e.tokens -= float64(n)
+	e.issued += int64(n)
+	return true
 }
 
-func (e *Engine) restock(t *nextTicket.Ticket) {
-	n, c := e.lockedNext()
-	if c {
-		t.Next(utils.Duration(n.Interval))
+// Takes n tokens, borrowing from future refills if needed, and returns how long
+// the caller has to wait until the tokens are available.
+func (e *Engine) Reserve(n int) (time.Duration, error) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if e.stop.Exited() {
+		return 0, ERROR_Closed
+	}
+	if n <= 0 {
+		return 0, ERROR_InvalidCount
+	}
+	if float64(n) > e.burst {
+		return 0, ERROR_ExceedsLimit
+	}
+	e.advance(e.clock.Now())
+	e.tokens -= float64(n)
+	e.issued += int64(n)
+	if e.tokens >= 0 {
+		return 0, nil
+	}
+	return time.Duration(-e.tokens / e.rate * float64(time.Second)), nil
+}
+
+// Blocks until n tokens are available or ctx is done, tokens are returned if ctx is done first.
+func (e *Engine) Wait(ctx context.Context, n int) error {
+	atomic.AddInt64(&e.waiters, 1)
+	defer atomic.AddInt64(&e.waiters, -1)
+	return wait(ctx, e.clock, n, e.Reserve, e.cancel, e.stop.Chan())
+}
+
+func (e *Engine) cancel(n int) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.advance(e.clock.Now())
+	e.tokens += float64(n)
+	e.issued -= int64(n)
+	if e.tokens > e.burst {
+		e.tokens = e.burst
 	}
-	e.stock <- n.Limit
 }
 
+// Not counted in Waiters, the pump isn't a caller.
 func (e *Engine) stockLoop() {
-	for {
+	for i := 1; ; i += 1 {
+		if err := wait(context.Background(), e.clock, 1, e.Reserve, e.cancel, e.stop.Chan()); err != nil {
+			return
+		}
 		select {
 		case <-e.stop.Chan():
 			return
-		case v := <-e.stock:
-			for i := 1; i <= v; i += 1 {
-				select {
-				case <-e.stop.Chan():
-					return
-				case e.ch <- i:
-					continue
-				}
-			}
+		case e.ch <- i:
+			continue
 		}
 	}
 }
 
+// Applies cfg right away, tokens earned so far are kept up to the new burst.
+// Invalid configs are ignored, check them with Config.Validate, and so are configs of
+// another algorithm, which need a new Limiter.
 func (e *Engine) Update(cfg *Config) {
-	cfg.changed = true
+	if cfg.Validate() != nil || cfg.LimiterAlgorithm() != TokenBucket {
+		return
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.advance(e.clock.Now())
+	e.apply(cfg)
+}
 
+// Returns the config in effect.
+func (e *Engine) Config() Config {
 	e.lock.Lock()
 	defer e.lock.Unlock()
-	e.next = cfg
+	return e.cfg
 }
 
+func (e *Engine) State() State {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.advance(e.clock.Now())
+	s := State{
+		Limit: int(e.burst),
+		Reset: time.Duration((e.burst - e.tokens) / e.rate * float64(time.Second)),
+	}
+	if e.tokens >= 1 {
+		s.Remaining = int(e.tokens)
+	} else {
+		s.Next = time.Duration((1 - e.tokens) / e.rate * float64(time.Second))
+	}
+	return s
+}
+
+func (e *Engine) Stats() Stats {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.advance(e.clock.Now())
+	return Stats{
+		Config:      e.cfg,
+		Tokens:      e.tokens,
+		Issued:      e.issued,
+		Dropped:     int64(e.dropped),
+		Waiters:     int(atomic.LoadInt64(&e.waiters)),
+		LastRestock: e.restocked,
+	}
+}
+
+// Logs the stats under name every interval until Close is called.
+func (e *Engine) StartStatsLog(name string, interval time.Duration) {
+	e.stop.Go(func() {
+		e.statsLoop(name, interval)
+	})
+}
+
+func (e *Engine) statsLoop(name string, interval time.Duration) {
+	t := e.clock.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-e.stop.Chan():
+			return
+		case <-t.C():
+			s := e.Stats()
+			log.With(log.Type("limiter"), log.String("name", name)).Infof("Issued %v, dropped %v, waiters %v, tokens %.2f of %v every %vs.",
+				s.Issued, s.Dropped, s.Waiters, s.Tokens, s.Config.Limit, s.Config.Interval)
+		}
+	}
+}
+
+// Returns a channel which yields a token each time it is read, the tokens are shared with
+// TryAcquire, Reserve and Wait.
 func (e *Engine) Chan() chan int {
+	e.pump.Do(func() {
+		e.stop.Go(e.stockLoop)
+	})
 	return e.ch
 }
 
+// Stops the engine and waits for its goroutines to exit, the channel of Chan is closed then.
 func (e *Engine) Close() {
-	if !e.stop.Exited() {
-		close(e.ch)
-		close(e.stock)
-	}
-	e.stop.Close()
+	e.stop.Shutdown(0)
+}
+
+// Closes the engine when g stops, along with the other hooks of g.
+func (e *Engine) StopWith(g *exitChan.Group) {
+	g.OnStop("limiter", 0, func(context.Context) error {
+		e.Close()
+		return nil
+	})
 }
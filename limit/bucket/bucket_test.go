@@ -1,60 +1,452 @@
 package limitBucket
 
 import (
-	"fmt"
+	"context"
+	"github.com/athlum/pkg/clock"
+	"github.com/athlum/pkg/exitChan"
+	"github.com/athlum/pkg/log"
+	"github.com/pkg/errors"
 	"sync"
 	"testing"
 	"time"
 )
 
+func init() {
+	log.Initialize(&log.Config{Disable: true})
+}
+
 func TestBucket(t *testing.T) {
-	e, err := New(&Config{
+	clk := clock.NewFake(time.Now())
+	e, err := NewWithClock(&Config{
 		Limit:    5,
 		Interval: 10.0,
-	})
+	}, clk)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer e.Close()
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	got := make(chan int, 100)
 	for i := 0; i < 2; i += 1 {
-		go func(i int, e *Engine) {
+		go func(e *Engine) {
 			for v := range e.Chan() {
-				fmt.Printf("%v echo %v: %v\n", time.Now(), i, v)
+				got <- v
 			}
-		}(i, e)
+		}(e)
+	}
+	expectNone := func() {
+		select {
+		case v := <-got:
+			t.Fatalf("token %v issued early", v)
+		case <-time.After(time.Millisecond * 5):
+		}
 	}
 
-	time.Sleep(time.Second * 20)
+	// The burst is issued right away, then a token every 2 seconds.
+	for i := 0; i < 5; i += 1 {
+		<-got
+	}
+	expectNone()
+	for i := 0; i < 10; i += 1 {
+		clk.BlockUntil(1)
+		clk.Advance(time.Second * 2)
+		<-got
+	}
+
+	// The token reserved under the old config is kept, the debt left is refilled at the new rate,
+	// then a token every 5 seconds.
 	e.Update(&Config{
 		Limit:    1,
 		Interval: 5,
 	})
-	wg.Wait()
+	clk.BlockUntil(1)
+	clk.Advance(time.Second * 2)
+	<-got
+	clk.BlockUntil(1)
+	clk.Advance(time.Second * 7)
+	expectNone()
+	clk.Advance(time.Second)
+	<-got
+	clk.BlockUntil(1)
+	clk.Advance(time.Second * 5)
+	<-got
+	// 18 tokens read, and the next one reserved.
+	clk.BlockUntil(1)
+	if s := e.Stats(); s.Issued != 19 || s.Waiters != 0 {
+		t.Fatalf("Stats().Issued = %v", s.Issued)
+	}
 }
 
 func TestBlockBucket(t *testing.T) {
-	e, err := New(&Config{
+	clk := clock.NewFake(time.Now())
+	e, err := NewWithClock(&Config{
 		Limit:    2400000000,
 		Interval: 1.0,
-	})
+	}, clk)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
 	defer e.Close()
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
+	// A huge burst is issued without ever waiting for a refill.
+	ch := e.Chan()
+	for i := 1; i <= 100000; i += 1 {
+		if v := <-ch; v != i {
+			t.Fatalf("token %v, expect %v", v, i)
+		}
+	}
+	if clk.Waiters() != 0 {
+		t.Fatal("the pump shouldn't wait while tokens are left")
+	}
 
-	go func(e *Engine) {
-		for v := range e.Chan() {
-			if v == 2400000000 {
-				fmt.Printf("%v echo: %v\n", time.Now(), v)
-			}
+	g := exitChan.NewGroup()
+	e.StopWith(g)
+	if err := g.Shutdown(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := <-ch; ok {
+		t.Fatal("Chan() should be closed once the group stopped")
+	}
+}
+
+func TestAcquire(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	e, err := NewWithClock(&Config{
+		Limit:    2,
+		Interval: 0.05,
+	}, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	if !e.TryAcquire(2) || e.TryAcquire(1) {
+		t.Fatal("TryAcquire should take the tokens of the current interval only")
+	}
+	if _, err := e.Reserve(3); err != ERROR_ExceedsLimit {
+		t.Fatalf("Reserve(3) = %v", err)
+	}
+	if _, err := e.Reserve(-1); err != ERROR_InvalidCount || e.TryAcquire(-1) || e.TryAcquire(0) {
+		t.Fatalf("Reserve(-1) = %v, non-positive counts should be rejected", err)
+	}
+	if d, err := e.Reserve(2); err != nil || d != time.Millisecond*50 {
+		t.Fatalf("Reserve(2) = %v, %v", d, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := e.Wait(ctx, 2); err != context.DeadlineExceeded {
+		t.Fatalf("Wait() = %v", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- e.Wait(context.Background(), 1)
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Millisecond * 74)
+	select {
+	case err := <-done:
+		t.Fatalf("Wait() = %v before the reserved tokens are restocked", err)
+	case <-time.After(time.Millisecond * 5):
+	}
+	clk.Advance(time.Millisecond)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	got := make(chan int, 1)
+	go func() {
+		got <- <-e.Chan()
+	}()
+	clk.BlockUntil(1)
+	clk.Advance(time.Millisecond * 25)
+	if v := <-got; v < 1 {
+		t.Fatalf("Chan() = %v", v)
+	}
+	e.Update(&Config{Limit: 9, Interval: 1, Algorithm: GCRA})
+	if c := e.Config(); c.Limit != 2 || c.LimiterAlgorithm() != TokenBucket {
+		t.Fatalf("Config() = %#v after an update to another algorithm", c)
+	}
+	e.Close()
+	if _, err := e.Reserve(1); err != ERROR_Closed {
+		t.Fatalf("Reserve() after Close = %v", err)
+	}
+}
+
+func TestLazyRefill(t *testing.T) {
+	cfg, err := ConfigFromJSON([]byte(`{"Limit": 1, "Interval": 0.004, "Burst": 5}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	clk := clock.NewFake(time.Now())
+	e, err := NewWithClock(cfg, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	if !e.TryAcquire(5) || e.TryAcquire(1) {
+		t.Fatal("a new bucket should hold exactly Burst tokens")
+	}
+	clk.Advance(time.Millisecond * 10)
+	if !e.TryAcquire(2) || e.TryAcquire(1) {
+		t.Fatal("tokens should refill from the elapsed time")
+	}
+
+	// Fractional rate: 1 token every 2.5 seconds, half a token is left.
+	e.Update(&Config{Limit: 2, Interval: 5})
+	if d, _ := e.Reserve(2); d != time.Millisecond*3750 {
+		t.Fatalf("Reserve(2) = %v", d)
+	}
+	if _, err := New(&Config{Limit: 1}); err == nil {
+		t.Fatal("a config without interval should be rejected")
+	}
+	e.Update(&Config{Limit: 0, Interval: 1})
+	if c := e.Config(); c.Limit != 2 {
+		t.Fatalf("invalid update was applied: %#v", c)
+	}
+}
+
+func TestStats(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	e, err := NewWithClock(&Config{Limit: 2, Interval: 0.01}, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+	clk.Advance(time.Millisecond * 20)
+	e.TryAcquire(2)
+	if s := e.Stats(); s.Issued != 2 || s.Dropped != 4 || s.Config.Limit != 2 || !s.LastRestock.Equal(clk.Now().Add(-time.Millisecond*20)) {
+		t.Fatalf("Stats() = %#v, a full bucket shouldn't be restocked", s)
+	}
+	clk.Advance(time.Millisecond * 20)
+	e.Stats()
+	restocked := clk.Now()
+	clk.Advance(time.Second)
+	if s := e.Stats(); s.Tokens != 2 || !s.LastRestock.Equal(restocked) {
+		t.Fatalf("Stats() = %#v, LastRestock should be the last refill, %v", s, restocked)
+	}
+	e.TryAcquire(2)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- e.Wait(ctx, 2)
+	}()
+	for e.Stats().Waiters != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	<-done
+	if s := e.Stats(); s.Waiters != 0 || s.Issued != 4 {
+		t.Fatalf("Stats() = %#v after the waiter gave up", s)
+	}
+	e.StartStatsLog("test", time.Millisecond)
+	time.Sleep(time.Millisecond * 5)
+}
+
+func TestLimiters(t *testing.T) {
+	for _, algorithm := range []string{"", TokenBucket, SlidingLog, SlidingWindow, GCRA} {
+		l, err := NewLimiter(&Config{Limit: 5, Interval: 0.1, Algorithm: algorithm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if s := l.State(); s.Limit != 5 || s.Remaining != 5 || s.Next != 0 || s.Reset != 0 {
+			t.Fatalf("%v: State() = %#v before any token is taken", algorithm, s)
+		}
+		if !l.TryAcquire(5) || l.TryAcquire(1) {
+			t.Fatalf("%v: TryAcquire should allow Limit tokens at once", algorithm)
+		}
+		if s := l.State(); s.Remaining != 0 || s.Next <= 0 || s.Reset < s.Next || s.Reset > time.Millisecond*200 {
+			t.Fatalf("%v: State() = %#v after the burst", algorithm, s)
+		}
+		time.Sleep(time.Millisecond * 50)
+		if l.TryAcquire(5) {
+			t.Fatalf("%v: TryAcquire should not allow a second burst within the interval", algorithm)
+		}
+		if _, err := l.Reserve(6); err != ERROR_ExceedsLimit {
+			t.Fatalf("%v: Reserve(6) = %v", algorithm, err)
+		}
+		if _, err := l.Reserve(0); err != ERROR_InvalidCount || l.TryAcquire(-1) {
+			t.Fatalf("%v: Reserve(0) = %v", algorithm, err)
+		}
+		// The sliding window may hold the burst for up to two windows, depending on their alignment.
+		d, err := l.Reserve(3)
+		if err != nil || d <= 0 || d > time.Millisecond*200 {
+			t.Fatalf("%v: Reserve(3) = %v, %v", algorithm, d, err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		if err := l.Wait(ctx, 5); err != context.DeadlineExceeded {
+			t.Fatalf("%v: Wait() = %v", algorithm, err)
+		}
+		cancel()
+		if err := l.Wait(context.Background(), 1); err != nil {
+			t.Fatalf("%v: Wait() = %v", algorithm, err)
+		}
+		l.Close()
+		if _, err := l.Reserve(1); err != ERROR_Closed {
+			t.Fatalf("%v: Reserve() after Close = %v", algorithm, err)
+		}
+	}
+	for _, algorithm := range []string{TokenBucket, SlidingLog, SlidingWindow, GCRA} {
+		// Sub-millisecond intervals are kept as they are.
+		l, err := NewLimiter(&Config{Limit: 1, Interval: 0.0005, Algorithm: algorithm})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !l.TryAcquire(1) || l.TryAcquire(1) {
+			t.Fatalf("%v: a sub-millisecond interval should still limit", algorithm)
+		}
+		l.State()
+		l.Close()
+		if _, err := NewLimiter(&Config{Limit: 1, Interval: 1e-10, Algorithm: algorithm}); errors.Cause(err) != ERROR_InvalidConfig {
+			t.Fatalf("%v: NewLimiter() = %v, an interval under a nanosecond should be rejected", algorithm, err)
 		}
-	}(e)
+	}
+	if _, err := NewLimiter(&Config{Limit: 10, Interval: 1e-9, Algorithm: GCRA}); errors.Cause(err) != ERROR_InvalidConfig {
+		t.Fatalf("NewLimiter() = %v, GCRA tokens less than a nanosecond apart should be rejected", err)
+	}
+	if _, err := NewLimiter(&Config{Limit: 1, Interval: 1, Algorithm: "unknown"}); errors.Cause(err) != ERROR_UnknownAlgorithm {
+		t.Fatalf("NewLimiter(unknown) = %v", err)
+	}
+}
+
+func TestLimitersWithClock(t *testing.T) {
+	for _, algorithm := range []string{TokenBucket, SlidingLog, SlidingWindow, GCRA} {
+		clk := clock.NewFake(time.Unix(1000, 0))
+		l, err := NewLimiterWithClock(&Config{Limit: 5, Interval: 10, Algorithm: algorithm}, clk)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !l.TryAcquire(5) || l.TryAcquire(1) {
+			t.Fatalf("%v: TryAcquire should allow Limit tokens at once", algorithm)
+		}
+		done := make(chan error)
+		go func() {
+			done <- l.Wait(context.Background(), 5)
+		}()
+		clk.BlockUntil(1)
+		clk.Advance(time.Second * 20)
+		if err := <-done; err != nil {
+			t.Fatalf("%v: Wait() = %v", algorithm, err)
+		}
+		clk.Advance(time.Second * 20)
+		if !l.TryAcquire(5) {
+			t.Fatalf("%v: tokens should be back once the fake clock moved on", algorithm)
+		}
+		l.Close()
+	}
+
+	clk := clock.NewFake(time.Unix(1000, 0))
+	s, err := NewShaperWithClock(&ShaperConfig{Limit: 1, Interval: 10, QueueSize: 1}, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.Submit(context.Background(), func() {})
+	done := make(chan error)
+	go func() {
+		done <- s.Submit(context.Background(), func() {})
+	}()
+	clk.BlockUntil(1)
+	select {
+	case err := <-done:
+		t.Fatalf("an item was let out before its turn: %v", err)
+	default:
+	}
+	clk.Advance(time.Second * 10)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
 
+func TestShaper(t *testing.T) {
+	s, err := NewShaper(&ShaperConfig{Limit: 10, Interval: 0.1, QueueSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 5; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := s.Submit(context.Background(), func() {}); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
 	wg.Wait()
+	if d := time.Since(start); d < time.Millisecond*40 {
+		t.Fatalf("5 items were let out in %v, expect 10ms apart", d)
+	}
+	s.Close()
+	if err := s.Submit(context.Background(), func() {}); err != ERROR_Closed {
+		t.Fatalf("Submit() after Close = %v", err)
+	}
+
+	// The first item is let out right away, the second one waits 200ms.
+	queued := func(policy QueuePolicy) (*Shaper, chan error) {
+		s, err := NewShaper(&ShaperConfig{Limit: 1, Interval: 0.2, QueueSize: 1, Policy: policy})
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Submit(context.Background(), func() {})
+		result := make(chan error, 1)
+		go func() {
+			result <- s.Submit(context.Background(), func() {})
+		}()
+		for s.Len() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+		return s, result
+	}
+	s, _ = queued(RejectWhenFull)
+	if err := s.Submit(context.Background(), func() {}); err != ERROR_QueueFull {
+		t.Fatalf("Submit() to a full queue = %v", err)
+	}
+	s.Close()
+
+	s, result := queued(DropOldest)
+	go s.Submit(context.Background(), func() {})
+	if err := <-result; err != ERROR_Dropped {
+		t.Fatalf("the oldest item got %v", err)
+	}
+	s.Close()
+
+	s, result = queued(BlockWhenFull)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	if err := s.Submit(ctx, func() {}); err != context.DeadlineExceeded {
+		t.Fatalf("Submit() blocked on a full queue = %v", err)
+	}
+	cancel()
+	s.Close()
+	if err := <-result; err != ERROR_Closed {
+		t.Fatalf("queued items should fail on Close, got %v", err)
+	}
+
+	s, err = NewShaper(&ShaperConfig{Limit: 1, Interval: 1, QueueSize: 1, Timeout: 0.01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Submit(context.Background(), func() {})
+	ran := false
+	if err := s.Submit(context.Background(), func() { ran = true }); err != ERROR_Timeout || ran {
+		t.Fatalf("an item waiting too long got %v", err)
+	}
+	s.Close()
+
+	if _, err := NewShaper(&ShaperConfig{Limit: 10, Interval: 1e-9, QueueSize: 1}); errors.Cause(err) != ERROR_InvalidConfig {
+		t.Fatalf("NewShaper() = %v, items less than a nanosecond apart should be rejected", err)
+	}
+	s, err = NewShaper(&ShaperConfig{Limit: 1, Interval: 1, QueueSize: 1, Timeout: 0.01, Policy: BlockWhenFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Submit(context.Background(), func() {})
+	go s.Submit(context.Background(), func() {})
+	for s.Len() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	if err := s.Submit(context.Background(), func() {}); err != ERROR_Timeout {
+		t.Fatalf("an item waiting too long for room got %v", err)
+	}
+	s.Close()
 }
@@ -2,18 +2,82 @@ package limitBucket
 
 import (
 	"encoding/json"
+	"github.com/pkg/errors"
+	"time"
 )
 
+var (
+	ERROR_InvalidConfig    = errors.New("invalid limit config.")
+	ERROR_UnknownAlgorithm = errors.New("unknown limit algorithm.")
+)
+
+// Limit tokens are allowed every Interval seconds, at most Burst tokens at once.
+// Burst defaults to Limit. Algorithm picks the Limiter built by NewLimiter, TokenBucket by default.
 type Config struct {
-	Limit    int
-	Interval float64
-	changed  bool
+	Limit     int
+	Interval  float64
+	Burst     int
+	Algorithm string
 }
 
 func (c *Config) Bytes() ([]byte, error) {
 	return json.Marshal(c)
 }
 
+func (c *Config) Validate() error {
+	if c.Limit <= 0 || c.Interval <= 0 || c.Burst < 0 || c.interval() <= 0 {
+		return errors.Wrapf(ERROR_InvalidConfig, "%#v", *c)
+	}
+	// GCRA spaces tokens emission apart.
+	if c.Algorithm == GCRA && c.emission() <= 0 {
+		return errors.Wrapf(ERROR_InvalidConfig, "%#v", *c)
+	}
+	switch c.Algorithm {
+	case "", TokenBucket, SlidingLog, SlidingWindow, GCRA:
+		return nil
+	}
+	return errors.Wrap(ERROR_UnknownAlgorithm, c.Algorithm)
+}
+
+// Interval as a duration, not rounded.
+func (c *Config) interval() time.Duration {
+	return time.Duration(c.Interval * float64(time.Second))
+}
+
+// Time between two tokens, zero if Limit tokens don't fit in Interval.
+func (c *Config) emission() time.Duration {
+	return c.interval() / time.Duration(c.Limit)
+}
+
+// Tokens refilled per second.
+func (c *Config) Rate() float64 {
+	return float64(c.Limit) / c.Interval
+}
+
+// Returns the algorithm NewLimiter builds for c, TokenBucket if Algorithm is empty.
+func (c *Config) LimiterAlgorithm() string {
+	if c.Algorithm == "" {
+		return TokenBucket
+	}
+	return c.Algorithm
+}
+
+// Returns c as applied by a limiter of algorithm, only the limits of another algorithm are kept.
+func (c *Config) as(algorithm string) Config {
+	d := *c
+	if d.LimiterAlgorithm() != algorithm {
+		d.Algorithm = algorithm
+	}
+	return d
+}
+
+func (c *Config) burst() int {
+	if c.Burst > 0 {
+		return c.Burst
+	}
+	return c.Limit
+}
+
 func ConfigFromJSON(b []byte) (*Config, error) {
 	c := &Config{}
 	if err := json.Unmarshal(b, c); err != nil {
@@ -0,0 +1,138 @@
+package limitBucket
+
+import (
+	"context"
+	"github.com/athlum/pkg/clock"
+	"github.com/athlum/pkg/exitChan"
+	"sync"
+	"time"
+)
+
+// Generic cell rate algorithm: tokens are spaced Interval/Limit apart and up to
+// Burst tokens may arrive early. Keeps a single timestamp per limiter.
+type GCRALimiter struct {
+	clock clock.Clock
+	lock  *sync.Mutex
+	stop  *exitChan.ExitChan
+
+	// Guarded by lock. tat is the theoretical arrival time of the next token.
+	cfg      Config
+	emission time.Duration
+	burst    int
+	tat      time.Time
+}
+
+func NewGCRA(cfg *Config) (*GCRALimiter, error) {
+	return NewGCRAWithClock(cfg, clock.Real)
+}
+
+// Same as NewGCRA, with the time of the limiter taken from clk.
+func NewGCRAWithClock(cfg *Config, clk clock.Clock) (*GCRALimiter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	l := &GCRALimiter{
+		clock: clock.Or(clk),
+		lock:  &sync.Mutex{},
+		stop:  exitChan.NewExitChan(),
+	}
+	l.apply(cfg)
+	return l, nil
+}
+
+func (l *GCRALimiter) apply(cfg *Config) {
+	l.cfg = cfg.as(GCRA)
+	l.emission = cfg.emission()
+	l.burst = cfg.burst()
+}
+
+// Returns the arrival time after n more tokens and the delay until they are allowed.
+// Must be called with lock held.
+func (l *GCRALimiter) next(now time.Time, n int) (time.Time, time.Duration) {
+	tat := l.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	newTat := tat.Add(time.Duration(n) * l.emission)
+	allowAt := newTat.Add(-time.Duration(l.burst) * l.emission)
+	if d := allowAt.Sub(now); d > 0 {
+		return newTat, d
+	}
+	return newTat, 0
+}
+
+func (l *GCRALimiter) TryAcquire(n int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stop.Exited() || n <= 0 || n > l.burst {
+		return false
+	}
+	tat, d := l.next(l.clock.Now(), n)
+	if d > 0 {
+		return false
+	}
+	l.tat = tat
+	return true
+}
+
+func (l *GCRALimiter) Reserve(n int) (time.Duration, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stop.Exited() {
+		return 0, ERROR_Closed
+	}
+	if n <= 0 {
+		return 0, ERROR_InvalidCount
+	}
+	if n > l.burst {
+		return 0, ERROR_ExceedsLimit
+	}
+	tat, d := l.next(l.clock.Now(), n)
+	l.tat = tat
+	return d, nil
+}
+
+func (l *GCRALimiter) Wait(ctx context.Context, n int) error {
+	return wait(ctx, l.clock, n, l.Reserve, l.cancel, l.stop.Chan())
+}
+
+func (l *GCRALimiter) cancel(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tat = l.tat.Add(-time.Duration(n) * l.emission)
+}
+
+func (l *GCRALimiter) Update(cfg *Config) {
+	if cfg.Validate() != nil || cfg.LimiterAlgorithm() != GCRA {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.apply(cfg)
+}
+
+func (l *GCRALimiter) Config() Config {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cfg
+}
+
+func (l *GCRALimiter) State() State {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	s := State{Limit: l.burst}
+	if l.tat.After(now) {
+		s.Reset = l.tat.Sub(now)
+	}
+	if remaining := l.burst - int((s.Reset+l.emission-1)/l.emission); remaining > 0 {
+		s.Remaining = remaining
+	} else {
+		_, s.Next = l.next(now, 1)
+	}
+	return s
+}
+
+func (l *GCRALimiter) Close() {
+	l.stop.Close()
+}
@@ -0,0 +1,85 @@
+package limitBucket
+
+import (
+	"context"
+	"github.com/athlum/pkg/clock"
+	"time"
+)
+
+const (
+	TokenBucket   = "tokenBucket"
+	SlidingLog    = "slidingLog"
+	SlidingWindow = "slidingWindow"
+	GCRA          = "gcra"
+)
+
+// A rate limiter allowing Config.Limit tokens per Config.Interval.
+type Limiter interface {
+	// Takes n tokens if they are available right now.
+	TryAcquire(n int) bool
+	// Takes n tokens and returns how long the caller has to wait until they are available.
+	Reserve(n int) (time.Duration, error)
+	// Blocks until n tokens are available or ctx is done.
+	Wait(ctx context.Context, n int) error
+	// Applies a new config, the algorithm of a limiter can't be changed.
+	Update(cfg *Config)
+	Config() Config
+	State() State
+	Close()
+}
+
+// A snapshot of a limiter, e.g. for X-RateLimit headers.
+type State struct {
+	Limit     int           // Tokens allowed at once.
+	Remaining int           // Tokens available right now.
+	Next      time.Duration // Until the next token is available, 0 if Remaining > 0.
+	Reset     time.Duration // Until all Limit tokens are available again.
+}
+
+var (
+	_ Limiter = (*Engine)(nil)
+	_ Limiter = (*SlidingLogLimiter)(nil)
+	_ Limiter = (*SlidingWindowLimiter)(nil)
+	_ Limiter = (*GCRALimiter)(nil)
+)
+
+// Creates the Limiter picked by cfg.Algorithm.
+func NewLimiter(cfg *Config) (Limiter, error) {
+	return NewLimiterWithClock(cfg, clock.Real)
+}
+
+// Same as NewLimiter, with the time of the limiter taken from clk.
+func NewLimiterWithClock(cfg *Config, clk clock.Clock) (Limiter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	switch cfg.Algorithm {
+	case SlidingLog:
+		return NewSlidingLogWithClock(cfg, clk)
+	case SlidingWindow:
+		return NewSlidingWindowWithClock(cfg, clk)
+	case GCRA:
+		return NewGCRAWithClock(cfg, clk)
+	default:
+		return NewWithClock(cfg, clk)
+	}
+}
+
+// Waits out a reservation, the tokens are handed back by cancel if ctx is done first.
+func wait(ctx context.Context, clk clock.Clock, n int, reserve func(int) (time.Duration, error), cancel func(int), stop <-chan struct{}) error {
+	d, err := reserve(n)
+	if err != nil || d == 0 {
+		return err
+	}
+	t := clk.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C():
+		return nil
+	case <-ctx.Done():
+		cancel(n)
+		return ctx.Err()
+	case <-stop:
+		return ERROR_Closed
+	}
+}
@@ -0,0 +1,251 @@
+package limitBucket
+
+import (
+	"container/list"
+	"context"
+	"github.com/athlum/pkg/clock"
+	"github.com/athlum/pkg/exitChan"
+	"github.com/pkg/errors"
+	"sync"
+	"time"
+)
+
+const (
+	RejectWhenFull QueuePolicy = iota // Submit fails with ERROR_QueueFull.
+	DropOldest                        // The oldest item in the queue fails with ERROR_Dropped.
+	BlockWhenFull                     // Submit waits for room.
+)
+
+var (
+	ERROR_QueueFull = errors.New("shaper queue full.")
+	ERROR_Dropped   = errors.New("dropped from shaper queue.")
+	ERROR_Timeout   = errors.New("timed out in shaper queue.")
+)
+
+// Decides what Submit does when the queue of a Shaper is full.
+type QueuePolicy int
+
+// Items are let out at Limit per Interval seconds, one at a time, while at most QueueSize wait.
+type ShaperConfig struct {
+	Limit     int
+	Interval  float64
+	QueueSize int
+	Timeout   float64 // Seconds an item may wait in the queue, forever if 0.
+	Policy    QueuePolicy
+}
+
+func (c *ShaperConfig) Validate() error {
+	if c.Limit <= 0 || c.Interval <= 0 || c.QueueSize <= 0 || c.Timeout < 0 || c.emission() <= 0 {
+		return errors.Wrapf(ERROR_InvalidConfig, "%#v", *c)
+	}
+	switch c.Policy {
+	case RejectWhenFull, DropOldest, BlockWhenFull:
+		return nil
+	}
+	return errors.Wrapf(ERROR_InvalidConfig, "%#v", *c)
+}
+
+// Time between two items, zero if Limit items don't fit in Interval.
+func (c *ShaperConfig) emission() time.Duration {
+	return time.Duration(c.Interval*float64(time.Second)) / time.Duration(c.Limit)
+}
+
+type shaperItem struct {
+	elem   *list.Element
+	result chan error
+}
+
+// A leaky bucket: callers are delayed in a bounded queue instead of rejected,
+// and let out at a fixed rate without bursts.
+type Shaper struct {
+	clock    clock.Clock
+	cfg      ShaperConfig
+	emission time.Duration
+	timeout  time.Duration
+	stop     *exitChan.Group // Runs the drain loop.
+	pending  chan struct{}   // Signaled when an item is queued.
+
+	// Guarded by lock. room is closed and replaced whenever an item leaves the queue.
+	lock  sync.Mutex
+	queue *list.List
+	room  chan struct{}
+}
+
+func NewShaper(cfg *ShaperConfig) (*Shaper, error) {
+	return NewShaperWithClock(cfg, clock.Real)
+}
+
+// Same as NewShaper, with the pace and the timeouts driven by clk.
+func NewShaperWithClock(cfg *ShaperConfig, clk clock.Clock) (*Shaper, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	s := &Shaper{
+		clock:    clock.Or(clk),
+		cfg:      *cfg,
+		emission: cfg.emission(),
+		timeout:  time.Duration(cfg.Timeout * float64(time.Second)),
+		stop:     exitChan.NewGroup(),
+		pending:  make(chan struct{}, 1),
+		queue:    list.New(),
+		room:     make(chan struct{}),
+	}
+	s.stop.Go(s.drainLoop)
+	return s, nil
+}
+
+// Waits in the queue for the turn of the caller, then runs f. f isn't run if an error is returned.
+// The timeout counts the wait for room in a full queue as well.
+func (s *Shaper) Submit(ctx context.Context, f func()) error {
+	var timeout <-chan time.Time
+	if s.timeout > 0 {
+		t := s.clock.NewTimer(s.timeout)
+		defer t.Stop()
+		timeout = t.C()
+	}
+	it, err := s.enqueue(ctx, timeout)
+	if err != nil {
+		return err
+	}
+	select {
+	case err := <-it.result:
+		if err != nil {
+			return err
+		}
+		f()
+		return nil
+	case <-ctx.Done():
+		err = ctx.Err()
+	case <-timeout:
+		err = ERROR_Timeout
+	}
+	if !s.remove(it) {
+		// Its turn came meanwhile, it's given up anyway.
+		<-it.result
+	}
+	return err
+}
+
+func (s *Shaper) enqueue(ctx context.Context, timeout <-chan time.Time) (*shaperItem, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		if s.stop.Exited() {
+			return nil, ERROR_Closed
+		}
+		if s.queue.Len() < s.cfg.QueueSize {
+			break
+		}
+		if s.cfg.Policy == RejectWhenFull {
+			return nil, ERROR_QueueFull
+		}
+		if s.cfg.Policy == DropOldest {
+			s.release(s.queue.Front(), ERROR_Dropped)
+			continue
+		}
+		room := s.room
+		s.lock.Unlock()
+		select {
+		case <-room:
+		case <-ctx.Done():
+			s.lock.Lock()
+			return nil, ctx.Err()
+		case <-timeout:
+			s.lock.Lock()
+			return nil, ERROR_Timeout
+		case <-s.stop.Chan():
+		}
+		s.lock.Lock()
+	}
+	it := &shaperItem{result: make(chan error, 1)}
+	it.elem = s.queue.PushBack(it)
+	select {
+	case s.pending <- struct{}{}:
+	default:
+	}
+	return it, nil
+}
+
+// Takes the item out of the queue with err as its result, must be called with lock held.
+func (s *Shaper) release(elem *list.Element, err error) {
+	it := s.queue.Remove(elem).(*shaperItem)
+	it.elem = nil
+	it.result <- err
+	close(s.room)
+	s.room = make(chan struct{})
+}
+
+// Takes the item out of the queue if it is still waiting.
+func (s *Shaper) remove(it *shaperItem) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if it.elem == nil {
+		return false
+	}
+	s.queue.Remove(it.elem)
+	it.elem = nil
+	close(s.room)
+	s.room = make(chan struct{})
+	return true
+}
+
+// Lets the front item out, returns false if the queue is empty.
+func (s *Shaper) next() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	front := s.queue.Front()
+	if front == nil {
+		return false
+	}
+	s.release(front, nil)
+	return true
+}
+
+// Lets an item out every emission interval. After Close, the items left fail with ERROR_Closed.
+func (s *Shaper) drainLoop() {
+	defer s.fail(ERROR_Closed)
+	last := s.clock.Now().Add(-s.emission)
+	for {
+		if s.Len() == 0 {
+			select {
+			case <-s.pending:
+				continue
+			case <-s.stop.Chan():
+				return
+			}
+		}
+		if d := s.emission - s.clock.Now().Sub(last); d > 0 {
+			t := s.clock.NewTimer(d)
+			select {
+			case <-t.C():
+			case <-s.stop.Chan():
+				t.Stop()
+				return
+			}
+		}
+		if s.next() {
+			last = s.clock.Now()
+		}
+	}
+}
+
+// Takes every item out of the queue with err as its result.
+func (s *Shaper) fail(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for s.queue.Len() > 0 {
+		s.release(s.queue.Front(), err)
+	}
+}
+
+// Returns the number of items waiting.
+func (s *Shaper) Len() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.queue.Len()
+}
+
+// Stops taking new items, the queued ones fail with ERROR_Closed.
+func (s *Shaper) Close() {
+	s.stop.Shutdown(0)
+}
@@ -0,0 +1,155 @@
+package limitBucket
+
+import (
+	"context"
+	"github.com/athlum/pkg/clock"
+	"github.com/athlum/pkg/exitChan"
+	"sync"
+	"time"
+)
+
+// Allows Limit tokens within any window of Interval, by keeping the time of every token.
+// Exact, but holds Limit timestamps in memory.
+type SlidingLogLimiter struct {
+	clock clock.Clock
+	lock  *sync.Mutex
+	stop  *exitChan.ExitChan
+
+	// Guarded by lock. Grant times in ascending order, reservations are in the future.
+	cfg    Config
+	window time.Duration
+	log    []time.Time
+}
+
+func NewSlidingLog(cfg *Config) (*SlidingLogLimiter, error) {
+	return NewSlidingLogWithClock(cfg, clock.Real)
+}
+
+// Same as NewSlidingLog, with the time of the limiter taken from clk.
+func NewSlidingLogWithClock(cfg *Config, clk clock.Clock) (*SlidingLogLimiter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	l := &SlidingLogLimiter{
+		clock: clock.Or(clk),
+		lock:  &sync.Mutex{},
+		stop:  exitChan.NewExitChan(),
+	}
+	l.apply(cfg)
+	return l, nil
+}
+
+func (l *SlidingLogLimiter) apply(cfg *Config) {
+	l.cfg = cfg.as(SlidingLog)
+	l.window = cfg.interval()
+}
+
+// Drops the grants which left the window, must be called with lock held.
+func (l *SlidingLogLimiter) evict(now time.Time) {
+	start := now.Add(-l.window)
+	i := 0
+	for i < len(l.log) && !l.log[i].After(start) {
+		i += 1
+	}
+	if i > 0 {
+		l.log = append(l.log[:0], l.log[i:]...)
+	}
+}
+
+func (l *SlidingLogLimiter) grant(t time.Time, n int) {
+	for i := 0; i < n; i += 1 {
+		l.log = append(l.log, t)
+	}
+}
+
+func (l *SlidingLogLimiter) TryAcquire(n int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stop.Exited() || n <= 0 {
+		return false
+	}
+	now := l.clock.Now()
+	l.evict(now)
+	if len(l.log)+n > l.cfg.Limit {
+		return false
+	}
+	l.grant(now, n)
+	return true
+}
+
+func (l *SlidingLogLimiter) Reserve(n int) (time.Duration, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stop.Exited() {
+		return 0, ERROR_Closed
+	}
+	if n <= 0 {
+		return 0, ERROR_InvalidCount
+	}
+	if n > l.cfg.Limit {
+		return 0, ERROR_ExceedsLimit
+	}
+	now := l.clock.Now()
+	l.evict(now)
+	t := now
+	if over := len(l.log) + n - l.cfg.Limit; over > 0 {
+		// The over-th oldest grant has to leave the window first.
+		t = l.log[over-1].Add(l.window)
+	}
+	if last := len(l.log) - 1; last >= 0 && l.log[last].After(t) {
+		t = l.log[last]
+	}
+	l.grant(t, n)
+	return t.Sub(now), nil
+}
+
+func (l *SlidingLogLimiter) Wait(ctx context.Context, n int) error {
+	return wait(ctx, l.clock, n, l.Reserve, l.cancel, l.stop.Chan())
+}
+
+// Drops the latest n grants.
+func (l *SlidingLogLimiter) cancel(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if n > len(l.log) {
+		n = len(l.log)
+	}
+	l.log = l.log[:len(l.log)-n]
+}
+
+func (l *SlidingLogLimiter) Update(cfg *Config) {
+	if cfg.Validate() != nil || cfg.LimiterAlgorithm() != SlidingLog {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.apply(cfg)
+}
+
+func (l *SlidingLogLimiter) Config() Config {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cfg
+}
+
+func (l *SlidingLogLimiter) State() State {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	l.evict(now)
+	used := len(l.log)
+	s := State{Limit: l.cfg.Limit}
+	if used > 0 {
+		s.Reset = l.log[used-1].Add(l.window).Sub(now)
+	}
+	if used < l.cfg.Limit {
+		s.Remaining = l.cfg.Limit - used
+	} else {
+		s.Next = l.log[used-l.cfg.Limit].Add(l.window).Sub(now)
+	}
+	return s
+}
+
+func (l *SlidingLogLimiter) Close() {
+	l.stop.Close()
+}
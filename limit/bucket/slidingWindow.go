@@ -0,0 +1,176 @@
+package limitBucket
+
+import (
+	"context"
+	"github.com/athlum/pkg/clock"
+	"github.com/athlum/pkg/exitChan"
+	"sync"
+	"time"
+)
+
+// Approximates a sliding window of Interval with the counts of two fixed windows,
+// the previous count is weighted by how much of it still overlaps the sliding window.
+type SlidingWindowLimiter struct {
+	clock clock.Clock
+	lock  *sync.Mutex
+	stop  *exitChan.ExitChan
+
+	// Guarded by lock. Counts by window index, reservations count in future windows.
+	cfg    Config
+	window time.Duration
+	counts map[int64]int
+}
+
+func NewSlidingWindow(cfg *Config) (*SlidingWindowLimiter, error) {
+	return NewSlidingWindowWithClock(cfg, clock.Real)
+}
+
+// Same as NewSlidingWindow, with the time of the limiter taken from clk.
+func NewSlidingWindowWithClock(cfg *Config, clk clock.Clock) (*SlidingWindowLimiter, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	l := &SlidingWindowLimiter{
+		clock:  clock.Or(clk),
+		lock:   &sync.Mutex{},
+		stop:   exitChan.NewExitChan(),
+		counts: make(map[int64]int),
+	}
+	l.apply(cfg)
+	return l, nil
+}
+
+func (l *SlidingWindowLimiter) apply(cfg *Config) {
+	if w := cfg.interval(); w != l.window {
+		// Window indexes change with the window size.
+		l.counts = make(map[int64]int)
+		l.window = w
+	}
+	l.cfg = cfg.as(SlidingWindow)
+}
+
+// Finds the earliest time from now when n more tokens fit, and the window it falls in.
+// Must be called with lock held.
+func (l *SlidingWindowLimiter) find(now time.Time, n int) (time.Time, int64) {
+	w := int64(l.window)
+	i := now.UnixNano() / w
+	for k := range l.counts {
+		if k < i-1 {
+			delete(l.counts, k)
+		}
+	}
+	elapsed := float64(now.UnixNano()-i*w) / float64(w)
+	limit := float64(l.cfg.Limit)
+	for {
+		prev, cur := float64(l.counts[i-1]), float64(l.counts[i])
+		if cur+float64(n) <= limit {
+			if prev*(1-elapsed)+cur+float64(n) > limit {
+				elapsed = 1 - (limit-cur-float64(n))/prev
+			}
+			t := time.Unix(0, i*w+int64(elapsed*float64(w)))
+			if t.Before(now) {
+				t = now
+			}
+			return t, i
+		}
+		i += 1
+		elapsed = 0
+	}
+}
+
+func (l *SlidingWindowLimiter) TryAcquire(n int) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stop.Exited() || n <= 0 || n > l.cfg.Limit {
+		return false
+	}
+	now := l.clock.Now()
+	t, i := l.find(now, n)
+	if t.After(now) {
+		return false
+	}
+	l.counts[i] += n
+	return true
+}
+
+func (l *SlidingWindowLimiter) Reserve(n int) (time.Duration, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stop.Exited() {
+		return 0, ERROR_Closed
+	}
+	if n <= 0 {
+		return 0, ERROR_InvalidCount
+	}
+	if n > l.cfg.Limit {
+		return 0, ERROR_ExceedsLimit
+	}
+	now := l.clock.Now()
+	t, i := l.find(now, n)
+	l.counts[i] += n
+	return t.Sub(now), nil
+}
+
+func (l *SlidingWindowLimiter) Wait(ctx context.Context, n int) error {
+	return wait(ctx, l.clock, n, l.Reserve, l.cancel, l.stop.Chan())
+}
+
+// Takes n back from the latest window holding them.
+func (l *SlidingWindowLimiter) cancel(n int) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	latest, found := int64(0), false
+	for k, c := range l.counts {
+		if c >= n && (!found || k > latest) {
+			latest, found = k, true
+		}
+	}
+	if found {
+		l.counts[latest] -= n
+	}
+}
+
+func (l *SlidingWindowLimiter) Update(cfg *Config) {
+	if cfg.Validate() != nil || cfg.LimiterAlgorithm() != SlidingWindow {
+		return
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.apply(cfg)
+}
+
+func (l *SlidingWindowLimiter) Config() Config {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.cfg
+}
+
+func (l *SlidingWindowLimiter) State() State {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.clock.Now()
+	t, _ := l.find(now, 1)
+	w := int64(l.window)
+	i := now.UnixNano() / w
+	elapsed := float64(now.UnixNano()-i*w) / float64(w)
+	used := float64(l.counts[i-1])*(1-elapsed) + float64(l.counts[i])
+	s := State{Limit: l.cfg.Limit, Next: t.Sub(now)}
+	if s.Next == 0 && used < float64(l.cfg.Limit) {
+		s.Remaining = int(float64(l.cfg.Limit) - used)
+	}
+	latest := int64(-1)
+	for k, c := range l.counts {
+		if c > 0 && k > latest {
+			latest = k
+		}
+	}
+	if latest >= 0 {
+		// A window stops counting once the next one is over.
+		s.Reset = time.Unix(0, (latest+2)*w).Sub(now)
+	}
+	return s
+}
+
+func (l *SlidingWindowLimiter) Close() {
+	l.stop.Close()
+}
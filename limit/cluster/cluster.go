@@ -0,0 +1,278 @@
+package limitCluster
+
+import (
+	"github.com/athlum/pkg/exitChan"
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/athlum/pkg/log"
+	"github.com/athlum/pkg/utils"
+	"github.com/athlum/pkg/zk"
+	"github.com/pkg/errors"
+	gozk "github.com/samuel/go-zookeeper/zk"
+	"path"
+	"sort"
+	"sync"
+)
+
+var ERROR_InvalidPath = errors.New("invalid member path.")
+
+const DefaultFlushInterval = 30.0
+
+type Config struct {
+	Limit         *limitBucket.Config // Cluster-wide limit, split among the live members.
+	Path          string              // Absolute path the members register under.
+	FlushInterval float64             // Seconds between full reads of the members, DefaultFlushInterval if 0.
+}
+
+// A replica of a cluster sharing a single limit. Each member registers an ephemeral node
+// under Config.Path and limits itself to its share of the limit, which is rebalanced
+// whenever members join or leave. Only one Member of a path is allowed per ZK.
+// A member can't have a burst below 1, so with more members than the global burst
+// (Burst, or Limit if unset) up to one token per member may be issued at once,
+// more than the global burst. Keep the burst at least the number of replicas.
+type Member struct {
+	limitBucket.Limiter
+	zk     *zk.ZK
+	cfg    Config
+	tree   *zk.TreeNode
+	stop   *exitChan.ExitChan
+	quit   chan struct{}
+	done   chan struct{}
+	closed *sync.Once
+
+	// Guarded by lock.
+	lock    sync.Mutex
+	global  limitBucket.Config
+	node    string
+	members map[string]struct{}
+}
+
+// Registers a member under cfg.Path and starts following the others.
+func Join(z *zk.ZK, cfg *Config) (*Member, error) {
+	if err := cfg.Limit.Validate(); err != nil {
+		return nil, err
+	}
+	if len(cfg.Path) < 2 || cfg.Path[0] != '/' {
+		return nil, errors.Wrap(ERROR_InvalidPath, cfg.Path)
+	}
+	if err := z.EnsurePath(cfg.Path); err != nil {
+		return nil, errors.Wrap(err, "failed to create member path:")
+	}
+	l, err := limitBucket.NewLimiter(cfg.Limit)
+	if err != nil {
+		return nil, err
+	}
+	m := &Member{
+		Limiter: l,
+		zk:      z,
+		cfg:     *cfg,
+		stop:    exitChan.NewExitChan(),
+		quit:    make(chan struct{}),
+		done:    make(chan struct{}),
+		closed:  &sync.Once{},
+		global:  *cfg.Limit,
+		members: make(map[string]struct{}),
+	}
+	if m.cfg.FlushInterval <= 0 {
+		m.cfg.FlushInterval = DefaultFlushInterval
+	}
+	if err := m.register(); err != nil {
+		l.Close()
+		return nil, err
+	}
+	children, _, err := z.Session().Children(cfg.Path)
+	if err != nil {
+		m.unregister()
+		l.Close()
+		return nil, err
+	}
+	m.lock.Lock()
+	for _, c := range children {
+		m.members[path.Join(cfg.Path, c)] = struct{}{}
+	}
+	m.rebalance()
+	m.lock.Unlock()
+
+	m.tree, err = z.WatchNode(cfg.Path, "", nil, utils.Duration(m.cfg.FlushInterval))
+	if err != nil {
+		m.unregister()
+		l.Close()
+		return nil, err
+	}
+	go m.loop()
+	if err := m.tree.Init(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *Member) register() error {
+	acls := m.zk.Acls
+	if len(acls) == 0 {
+		acls = gozk.WorldACL(gozk.PermAll)
+	}
+	// Created under lock, so a Close meanwhile either sees the node or prevents it.
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.stop.Exited() {
+		return nil
+	}
+	node, err := m.zk.Session().Create(path.Join(m.cfg.Path, "member-"), []byte(m.zk.Address), gozk.FlagEphemeral|gozk.FlagSequence, acls)
+	if err != nil {
+		return errors.Wrap(err, "failed to register member:")
+	}
+	m.node = node
+	m.members[node] = struct{}{}
+	m.rebalance()
+	return nil
+}
+
+func (m *Member) unregister() {
+	m.lock.Lock()
+	node := m.node
+	m.lock.Unlock()
+	if err := m.zk.Session().Delete(node, -1); err != nil && err != gozk.ErrNoNode {
+		log.With(log.Type("limitCluster")).Errorf("Unregister %v failed: %v", node, err.Error())
+	}
+}
+
+func (m *Member) loop() {
+	defer close(m.done)
+	for {
+		select {
+		case <-m.quit:
+			return
+		case e := <-m.tree.Event:
+			m.handle(e)
+		}
+	}
+}
+
+func (m *Member) handle(e *zk.NodeEvent) {
+	if path.Dir(e.Path) != m.cfg.Path {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	switch e.Event {
+	case zk.NodeNew, zk.NodeUpdate:
+		if _, ok := m.members[e.Path]; ok {
+			return
+		}
+		m.members[e.Path] = struct{}{}
+	case zk.NodeRemoved:
+		if _, ok := m.members[e.Path]; !ok {
+			return
+		}
+		delete(m.members, e.Path)
+		if e.Path == m.node && !m.stop.Exited() {
+			// Our node is gone with the session, register again to take our share back.
+			log.With(log.Type("limitCluster")).Errorf("Member %v removed, registering again.", e.Path)
+			go func() {
+				if err := m.register(); err != nil {
+					log.With(log.Type("limitCluster")).Errorf("Register failed: %v", err.Error())
+				}
+			}()
+		}
+	}
+	m.rebalance()
+}
+
+// Applies this member's share of the global limit, must be called with lock held.
+func (m *Member) rebalance() {
+	ids := make([]string, 0, len(m.members)+1)
+	for id := range m.members {
+		ids = append(ids, id)
+	}
+	if _, ok := m.members[m.node]; !ok {
+		ids = append(ids, m.node)
+	}
+	sort.Strings(ids)
+	cfg := share(&m.global, len(ids), sort.SearchStrings(ids, m.node))
+	if *cfg == m.Limiter.Config() {
+		return
+	}
+	m.Limiter.Update(cfg)
+	log.With(log.Type("limitCluster")).Infof("Rebalanced %v among %v members, limit %v every %vs.", m.cfg.Path, len(ids), cfg.Limit, cfg.Interval)
+}
+
+// Splits the global cfg among n members, i is the index of this member.
+// The shares add up to cfg.Limit, members get a longer interval if there are more members than tokens.
+// Bursts are split the same way but never below 1, so they only add up to cfg.Burst while it is
+// at least n.
+func share(cfg *limitBucket.Config, n, i int) *limitBucket.Config {
+	c := *cfg
+	if n <= 1 {
+		return &c
+	}
+	if cfg.Limit >= n {
+		c.Limit = split(cfg.Limit, n, i)
+	} else {
+		c.Limit = 1
+		c.Interval = cfg.Interval * float64(n) / float64(cfg.Limit)
+	}
+	if cfg.Burst > 0 {
+		if c.Burst = split(cfg.Burst, n, i); c.Burst == 0 {
+			c.Burst = 1
+		}
+	}
+	return &c
+}
+
+func split(total, n, i int) int {
+	s := total / n
+	if i < total%n {
+		s += 1
+	}
+	return s
+}
+
+// Sets the global limit, this member's share is applied right away and the other
+// members are expected to receive the same update. Invalid configs are ignored,
+// as are configs of another algorithm since the limiter keeps its own.
+func (m *Member) Update(cfg *limitBucket.Config) {
+	if cfg.Validate() != nil {
+		return
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if cfg.LimiterAlgorithm() != m.global.LimiterAlgorithm() {
+		return
+	}
+	m.global = *cfg
+	m.rebalance()
+}
+
+// Returns the global limit, Config returns this member's share of it.
+func (m *Member) Global() limitBucket.Config {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.global
+}
+
+// Returns the number of live members known, including this one.
+func (m *Member) Members() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, ok := m.members[m.node]; ok {
+		return len(m.members)
+	}
+	return len(m.members) + 1
+}
+
+// Leaves the cluster, the others take over the share of this member.
+func (m *Member) Close() {
+	m.closed.Do(func() {
+		m.lock.Lock()
+		m.stop.Close()
+		m.lock.Unlock()
+		// Clearing the tree emits its removal, so it's done before the loop quits.
+		if err := m.tree.Clear(); err != nil {
+			log.With(log.Type("limitCluster")).Errorf("Clear failed on %v: %v", m.cfg.Path, err.Error())
+		}
+		close(m.quit)
+		<-m.done
+		m.unregister()
+		m.Limiter.Close()
+	})
+}
@@ -0,0 +1,96 @@
+package limitCluster
+
+import (
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/athlum/pkg/log"
+	"github.com/athlum/pkg/zk"
+	"github.com/athlum/pkg/zk/zktest"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.Initialize(&log.Config{Disable: true})
+}
+
+func TestShare(t *testing.T) {
+	cfg := &limitBucket.Config{Limit: 10, Interval: 1, Burst: 4}
+	limit, burst := 0, 0
+	for i := 0; i < 3; i++ {
+		c := share(cfg, 3, i)
+		limit += c.Limit
+		burst += c.Burst
+	}
+	if limit != 10 || burst != 4 {
+		t.Fatalf("shares add up to %v/%v", limit, burst)
+	}
+	c := share(&limitBucket.Config{Limit: 2, Interval: 1}, 4, 3)
+	if c.Limit != 1 || c.Interval != 2 {
+		t.Fatalf("share of 2 tokens among 4 members is %#v", *c)
+	}
+}
+
+func waitMembers(t *testing.T, ms []*Member, n int) {
+	deadline := time.Now().Add(time.Second * 5)
+	for _, m := range ms {
+		for m.Members() != n {
+			if time.Now().After(deadline) {
+				t.Fatalf("Members() = %v, expect %v", m.Members(), n)
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+	}
+}
+
+func totalLimit(ms []*Member) int {
+	total := 0
+	for _, m := range ms {
+		total += m.Config().Limit
+	}
+	return total
+}
+
+func TestMembers(t *testing.T) {
+	server := zktest.NewServer()
+	cfg := &Config{
+		Limit: &limitBucket.Config{Limit: 9, Interval: 1},
+		Path:  "/limits/api",
+	}
+	var ms []*Member
+	for i := 0; i < 3; i++ {
+		z, err := zk.NewZKWithDialer(&zk.Config{RootPath: "/"}, server.Dial)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m, err := Join(z, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ms = append(ms, m)
+	}
+	waitMembers(t, ms, 3)
+	if n := totalLimit(ms); n != 9 {
+		t.Fatalf("members share %v tokens, expect 9", n)
+	}
+
+	ms[0].Close()
+	ms = ms[1:]
+	waitMembers(t, ms, 2)
+	if n := totalLimit(ms); n != 9 {
+		t.Fatalf("members share %v tokens after one left, expect 9", n)
+	}
+
+	for _, m := range ms {
+		m.Update(&limitBucket.Config{Limit: 4, Interval: 1})
+	}
+	if n := totalLimit(ms); n != 4 {
+		t.Fatalf("members share %v tokens after update, expect 4", n)
+	}
+	ms[0].Update(&limitBucket.Config{Limit: 8, Interval: 1, Algorithm: limitBucket.GCRA})
+	if g := ms[0].Global(); g.Limit != 4 || g.LimiterAlgorithm() != limitBucket.TokenBucket {
+		t.Fatalf("Global() = %#v, a change of algorithm should be ignored", g)
+	}
+	for _, m := range ms {
+		m.Close()
+	}
+}
@@ -0,0 +1,218 @@
+package limitKeyed
+
+import (
+	"context"
+	"github.com/athlum/pkg/clock"
+	cmap "github.com/athlum/pkg/concurrentMap"
+	"github.com/athlum/pkg/exitChan"
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/pkg/errors"
+	"hash/fnv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	ERROR_InvalidConfig = errors.New("invalid keyed limit config.")
+)
+
+type Config struct {
+	Default     *limitBucket.Config // Config of keys without an override.
+	IdleTimeout float64             // Seconds a limiter is kept after its last use, never dropped if 0.
+	MaxKeys     int                 // Least recently used limiters are dropped above it, unbounded if 0.
+}
+
+// Idle limiters are swept every IdleTimeout/2, which must be a positive duration.
+func (c *Config) Validate() error {
+	if c.IdleTimeout < 0 || c.MaxKeys < 0 || (c.IdleTimeout > 0 && c.idleTimeout()/2 <= 0) {
+		return errors.Wrapf(ERROR_InvalidConfig, "%#v", *c)
+	}
+	return c.Default.Validate()
+}
+
+func (c *Config) idleTimeout() time.Duration {
+	return time.Duration(c.IdleTimeout * float64(time.Second))
+}
+
+type entry struct {
+	limitBucket.Limiter
+	lastUsed int64
+}
+
+func (e *entry) touch(now time.Time) {
+	atomic.StoreInt64(&e.lastUsed, now.UnixNano())
+}
+
+// One limiter per key, e.g. per API key or client IP, created on first use.
+// Limiters dropped for being idle, over MaxKeys or of a replaced algorithm aren't closed,
+// callers may still hold them from Get, they are only closed by Close.
+type Registry struct {
+	cfg       Config
+	clock     clock.Clock
+	dflt      atomic.Pointer[limitBucket.Config]
+	limiters  *cmap.Map[string, *entry]
+	overrides *cmap.Map[string, *limitBucket.Config]
+	stop      *exitChan.ExitChan
+	// Held for reading while limiters are created and for writing while configs change,
+	// so a config set during a creation isn't missed.
+	lock sync.RWMutex
+}
+
+func New(cfg *Config) (*Registry, error) {
+	return NewWithClock(cfg, clock.Real)
+}
+
+// Same as New, with the limiters and the idle sweep driven by clk.
+func NewWithClock(cfg *Config, clk clock.Clock) (*Registry, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	hasher := cmap.StringHasher(fnv.New32)
+	r := &Registry{
+		cfg:       *cfg,
+		clock:     clock.Or(clk),
+		limiters:  cmap.NewBoundedMap[string, *entry](hasher, 0, cfg.MaxKeys, cmap.LRU),
+		overrides: cmap.NewMap[string, *limitBucket.Config](hasher, 0),
+		stop:      exitChan.NewExitChan(),
+	}
+	r.dflt.Store(cfg.Default)
+	if cfg.IdleTimeout > 0 {
+		go r.sweepLoop(r.clock.NewTicker(cfg.idleTimeout()/2), cfg.idleTimeout())
+	}
+	return r, nil
+}
+
+func (r *Registry) config(key string) *limitBucket.Config {
+	if cfg, ok := r.overrides.Get(key); ok {
+		return cfg
+	}
+	return r.dflt.Load()
+}
+
+// Returns the limiter of key, creating it if absent.
+func (r *Registry) Get(key string) (limitBucket.Limiter, error) {
+	r.lock.RLock()
+	e, err := r.limiters.GetOrLoad(key, func() (*entry, error) {
+		l, err := limitBucket.NewLimiterWithClock(r.config(key), r.clock)
+		if err != nil {
+			return nil, err
+		}
+		return &entry{Limiter: l, lastUsed: r.clock.Now().UnixNano()}, nil
+	})
+	r.lock.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	e.touch(r.clock.Now())
+	return e.Limiter, nil
+}
+
+// Reports whether a single token of key is available right now.
+func (r *Registry) Allow(key string) bool {
+	l, err := r.Get(key)
+	if err != nil {
+		return false
+	}
+	return l.TryAcquire(1)
+}
+
+// Blocks until a single token of key is available or ctx is done.
+func (r *Registry) Wait(ctx context.Context, key string) error {
+	l, err := r.Get(key)
+	if err != nil {
+		return err
+	}
+	return l.Wait(ctx, 1)
+}
+
+// Sets the config of key, it is applied to the live limiter of key as well.
+func (r *Registry) SetOverride(key string, cfg *limitBucket.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.overrides.Set(key, cfg)
+	r.apply(key, cfg)
+	return nil
+}
+
+// Drops the override of key, which falls back to the default config.
+func (r *Registry) RemoveOverride(key string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if r.overrides.Remove(key) {
+		r.apply(key, r.dflt.Load())
+	}
+}
+
+// Replaces the default config, it is applied to the live limiters without an override.
+func (r *Registry) SetDefault(cfg *limitBucket.Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.dflt.Store(cfg)
+	r.limiters.Range(func(key string, e *entry) bool {
+		if !r.overrides.Has(key) {
+			r.apply(key, cfg)
+		}
+		return true
+	})
+	return nil
+}
+
+func (r *Registry) apply(key string, cfg *limitBucket.Config) {
+	e, ok := r.limiters.Get(key)
+	if !ok {
+		return
+	}
+	if c := e.Config(); c.LimiterAlgorithm() == cfg.LimiterAlgorithm() {
+		e.Update(cfg)
+		return
+	}
+	// Another algorithm, the limiter is created again on next use.
+	r.limiters.RemoveIf(key, func(v *entry) bool { return v == e })
+}
+
+// Returns the number of keys tracked.
+func (r *Registry) Count() int {
+	return r.limiters.Count()
+}
+
+func (r *Registry) sweepLoop(t clock.Ticker, timeout time.Duration) {
+	defer t.Stop()
+	for {
+		select {
+		case <-r.stop.Chan():
+			return
+		case <-t.C():
+			r.sweep(timeout)
+		}
+	}
+}
+
+// Drops the limiters unused for longer than timeout.
+func (r *Registry) sweep(timeout time.Duration) {
+	deadline := r.clock.Now().Add(-timeout).UnixNano()
+	r.limiters.Range(func(key string, e *entry) bool {
+		if atomic.LoadInt64(&e.lastUsed) >= deadline {
+			return true
+		}
+		r.limiters.RemoveIf(key, func(v *entry) bool {
+			return atomic.LoadInt64(&v.lastUsed) < deadline
+		})
+		return true
+	})
+}
+
+func (r *Registry) Close() {
+	r.stop.Close()
+	r.limiters.Range(func(key string, e *entry) bool {
+		e.Close()
+		return true
+	})
+	r.limiters.Clear()
+}
@@ -0,0 +1,104 @@
+package limitKeyed
+
+import (
+	"context"
+	"github.com/athlum/pkg/clock"
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/pkg/errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRegistry(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	r, err := NewWithClock(&Config{
+		Default:     &limitBucket.Config{Limit: 2, Interval: 10},
+		IdleTimeout: 0.05,
+		MaxKeys:     16,
+	}, clk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	if !r.Allow("a") || !r.Allow("a") || r.Allow("a") {
+		t.Fatal("a should be limited to 2 tokens")
+	}
+	if !r.Allow("b") {
+		t.Fatal("keys should not share a limiter")
+	}
+	if err := r.SetOverride("a", &limitBucket.Config{Limit: 5, Interval: 10}); err != nil {
+		t.Fatal(err)
+	}
+	l, _ := r.Get("a")
+	if l.Config().Limit != 5 {
+		t.Fatal("override should apply to the live limiter")
+	}
+	if err := r.SetOverride("c", &limitBucket.Config{Limit: 1, Interval: 10, Algorithm: limitBucket.GCRA}); err != nil {
+		t.Fatal(err)
+	}
+	if !r.Allow("c") || r.Allow("c") {
+		t.Fatal("c should be limited by its override")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := r.Wait(ctx, "c"); err != context.DeadlineExceeded {
+		t.Fatalf("Wait(c) = %v", err)
+	}
+
+	// An empty algorithm is the token bucket, so the limiter is updated in place.
+	b, _ := r.Get("b")
+	if err := r.SetDefault(&limitBucket.Config{Limit: 3, Interval: 10, Algorithm: limitBucket.TokenBucket}); err != nil {
+		t.Fatal(err)
+	}
+	if nb, _ := r.Get("b"); nb != b || b.Config().Limit != 3 {
+		t.Fatal("b should be updated in place")
+	}
+
+	for i := 0; i < 100; i++ {
+		r.Allow(strconv.Itoa(i))
+		if n := r.Count(); n > 16 {
+			t.Fatalf("Count() = %v, should be capped by MaxKeys", n)
+		}
+	}
+	if _, err := l.Reserve(1); err != nil {
+		t.Fatalf("Reserve() = %v, a limiter dropped from the registry should keep working", err)
+	}
+	clk.Advance(time.Millisecond * 100)
+	deadline := time.Now().Add(time.Second * 5)
+	for r.Count() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Count() = %v, idle limiters should be dropped", r.Count())
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := New(&Config{Default: &limitBucket.Config{Limit: 1, Interval: 1}, IdleTimeout: 1e-9}); errors.Cause(err) != ERROR_InvalidConfig {
+		t.Fatalf("New() = %v, an idle timeout too short to sweep should be rejected", err)
+	}
+}
+
+func TestOverrideWhileLoading(t *testing.T) {
+	r, err := New(&Config{Default: &limitBucket.Config{Limit: 2, Interval: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	for i := 0; i < 100; i += 1 {
+		key := strconv.Itoa(i)
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			r.Get(key)
+		}()
+		if err := r.SetOverride(key, &limitBucket.Config{Limit: 7, Interval: 10}); err != nil {
+			t.Fatal(err)
+		}
+		<-done
+		if l, _ := r.Get(key); l.Config().Limit != 7 {
+			t.Fatalf("the override of %v was lost while its limiter was created", key)
+		}
+	}
+}
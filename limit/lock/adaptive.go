@@ -0,0 +1,271 @@
+package limitLock
+
+import (
+	"context"
+	"github.com/athlum/pkg/log"
+	"github.com/athlum/pkg/utils"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	AIMD     = "aimd"
+	Vegas    = "vegas"
+	Gradient = "gradient"
+)
+
+var (
+	ERROR_InvalidConfig    = errors.New("invalid adaptive limit config.")
+	ERROR_Overloaded       = errors.New("overloaded.")
+	ERROR_UnknownAlgorithm = errors.New("unknown adaptive limit algorithm.")
+)
+
+// Zero values fall back to the defaults noted.
+type AdaptiveConfig struct {
+	Algorithm    string  // AIMD by default.
+	InitialLimit int64   // 20 by default, within MinLimit and MaxLimit.
+	MinLimit     int64   // 1 by default.
+	MaxLimit     int64   // 1000 by default.
+	Backoff      float64 // AIMD: ratio the limit is cut by on a drop, 0.9 by default.
+	Timeout      float64 // AIMD: seconds over which a sample counts as a drop, never if 0.
+	Tolerance    float64 // Gradient: how much the latency may grow over its long term average, 1.5 by default.
+	Smoothing    float64 // Gradient: weight of a new limit against the current one, 0.2 by default.
+}
+
+func (c *AdaptiveConfig) withDefaults() AdaptiveConfig {
+	d := *c
+	if d.Algorithm == "" {
+		d.Algorithm = AIMD
+	}
+	if d.MinLimit == 0 {
+		d.MinLimit = 1
+	}
+	if d.MaxLimit == 0 {
+		d.MaxLimit = 1000
+	}
+	if d.InitialLimit == 0 {
+		d.InitialLimit = 20
+		if d.InitialLimit > d.MaxLimit {
+			d.InitialLimit = d.MaxLimit
+		}
+		if d.InitialLimit < d.MinLimit {
+			d.InitialLimit = d.MinLimit
+		}
+	}
+	if d.Backoff == 0 {
+		d.Backoff = 0.9
+	}
+	if d.Tolerance == 0 {
+		d.Tolerance = 1.5
+	}
+	if d.Smoothing == 0 {
+		d.Smoothing = 0.2
+	}
+	return d
+}
+
+func (c *AdaptiveConfig) Validate() error {
+	d := c.withDefaults()
+	if d.MinLimit < 1 || d.MaxLimit < d.MinLimit || d.InitialLimit < d.MinLimit || d.InitialLimit > d.MaxLimit ||
+		d.Backoff <= 0 || d.Backoff >= 1 || d.Timeout < 0 || d.Tolerance < 1 || d.Smoothing <= 0 || d.Smoothing > 1 {
+		return errors.Wrapf(ERROR_InvalidConfig, "%#v", *c)
+	}
+	switch d.Algorithm {
+	case AIMD, Vegas, Gradient:
+		return nil
+	}
+	return errors.Wrap(ERROR_UnknownAlgorithm, d.Algorithm)
+}
+
+// Estimates the next limit from a sample. The estimate is a float so it can grow by fractions.
+type limitAlgorithm interface {
+	update(limit float64, rtt time.Duration, inflight int64, dropped bool) float64
+}
+
+// Additive increase, multiplicative decrease: grows by one while the limit is in use,
+// cut by Backoff on every drop.
+type aimd struct {
+	backoff float64
+	timeout time.Duration
+}
+
+func (a *aimd) update(limit float64, rtt time.Duration, inflight int64, dropped bool) float64 {
+	if dropped || (a.timeout > 0 && rtt > a.timeout) {
+		return limit * a.backoff
+	}
+	if float64(inflight)*2 >= limit {
+		return limit + 1
+	}
+	return limit
+}
+
+// TCP Vegas: estimates the queue from how far the latency is over the lowest seen,
+// grows while the queue is short and shrinks when it is long.
+type vegas struct {
+	noLoad time.Duration
+}
+
+func (v *vegas) update(limit float64, rtt time.Duration, inflight int64, dropped bool) float64 {
+	if rtt > 0 && (v.noLoad == 0 || rtt < v.noLoad) {
+		v.noLoad = rtt
+	}
+	step := math.Max(1, math.Log10(limit))
+	if dropped {
+		return limit - step
+	}
+	if rtt <= 0 || float64(inflight)*2 < limit {
+		return limit
+	}
+	queue := limit * (1 - float64(v.noLoad)/float64(rtt))
+	alpha, beta := 3*step, 6*step
+	switch {
+	case queue <= step:
+		return limit + beta
+	case queue < alpha:
+		return limit + step
+	case queue > beta:
+		return limit - step
+	}
+	return limit
+}
+
+// Compares the latency with its long term average, the limit follows the ratio
+// with room for a queue of sqrt(limit).
+type gradient struct {
+	tolerance float64
+	smoothing float64
+	long      float64
+}
+
+// Weight of a sample in the long term average latency, about the last 600 samples.
+const gradientWindow = 2.0 / 601
+
+func (g *gradient) update(limit float64, rtt time.Duration, inflight int64, dropped bool) float64 {
+	if rtt <= 0 {
+		return limit
+	}
+	short := float64(rtt)
+	if g.long == 0 {
+		g.long = short
+	} else {
+		g.long += (short - g.long) * gradientWindow
+	}
+	ratio := math.Max(0.5, math.Min(1, g.tolerance*g.long/short))
+	if dropped {
+		ratio = 0.5
+	}
+	next := limit*ratio + math.Sqrt(limit)
+	if next > limit && float64(inflight)*2 < limit {
+		// Not in use enough to tell whether more would help.
+		return limit
+	}
+	return limit*(1-g.smoothing) + next*g.smoothing
+}
+
+// A Lock which adjusts its limit from the latency and the drops observed, see Observe.
+type Adaptive struct {
+	sem *Lock
+	cfg AdaptiveConfig
+
+	// Guarded by lock.
+	lock     sync.Mutex
+	algo     limitAlgorithm
+	estimate float64
+	dropped  func(err error) bool
+}
+
+// Reports whether err is from overload: a deadline exceeded, or a rejection wrapping ERROR_Overloaded.
+// It's how Do classifies errors unless SetDropped is called.
+func Overloaded(err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) || errors.Is(err, ERROR_Overloaded)
+}
+
+func NewAdaptive(cfg *AdaptiveConfig) (*Adaptive, error) {
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	d := cfg.withDefaults()
+	a := &Adaptive{
+		sem:      New(d.InitialLimit),
+		cfg:      d,
+		estimate: float64(d.InitialLimit),
+		dropped:  Overloaded,
+	}
+	switch d.Algorithm {
+	case Vegas:
+		a.algo = &vegas{}
+	case Gradient:
+		a.algo = &gradient{tolerance: d.Tolerance, smoothing: d.Smoothing}
+	default:
+		a.algo = &aimd{backoff: d.Backoff, timeout: utils.Duration(d.Timeout)}
+	}
+	return a, nil
+}
+
+func (a *Adaptive) Acquire(ctx context.Context, n int64) error {
+	return a.sem.Acquire(ctx, n)
+}
+
+func (a *Adaptive) TryAcquire(n int64) bool {
+	return a.sem.TryAcquire(n)
+}
+
+func (a *Adaptive) Release(n int64) {
+	a.sem.Release(n)
+}
+
+// Feeds the latency of a call made under the limit, dropped tells whether it failed
+// from overload, e.g. timed out or got rejected.
+func (a *Adaptive) Observe(rtt time.Duration, dropped bool) {
+	inflight := a.sem.Used()
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	prev := a.sem.Limit()
+	a.estimate = a.algo.update(a.estimate, rtt, inflight, dropped)
+	a.estimate = math.Max(float64(a.cfg.MinLimit), math.Min(float64(a.cfg.MaxLimit), a.estimate))
+	if limit := int64(a.estimate); limit != prev {
+		a.sem.SetLimit(limit)
+		log.With(log.Type("limiter"), log.String("algorithm", a.cfg.Algorithm)).Debugf("Limit changed from %v to %v, latency %v, dropped %v.", prev, limit, rtt, dropped)
+	}
+}
+
+// Sets how Do tells the errors from overload apart from the others, Overloaded by default.
+func (a *Adaptive) SetDropped(f func(err error) bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.dropped = f
+}
+
+// Runs f holding n, its latency is observed. A panic, or an error from overload, counts as a drop.
+func (a *Adaptive) Do(ctx context.Context, n int64, f func() error) error {
+	if err := a.Acquire(ctx, n); err != nil {
+		return err
+	}
+	a.lock.Lock()
+	isDrop := a.dropped
+	a.lock.Unlock()
+	start := time.Now()
+	dropped := true
+	defer func() {
+		a.Observe(time.Since(start), dropped)
+		a.Release(n)
+	}()
+	err := f()
+	dropped = err != nil && isDrop(err)
+	return err
+}
+
+// Returns the current limit.
+func (a *Adaptive) Limit() int64 {
+	return a.sem.Limit()
+}
+
+func (a *Adaptive) Used() int64 {
+	return a.sem.Used()
+}
+
+func (a *Adaptive) Waiters() int {
+	return a.sem.Waiters()
+}
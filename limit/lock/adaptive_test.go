@@ -0,0 +1,94 @@
+package limitLock
+
+import (
+	"context"
+	"github.com/athlum/pkg/log"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.Initialize(&log.Config{Disable: true})
+}
+
+// Observes n samples with the whole limit in use.
+func observe(a *Adaptive, n int, rtt time.Duration, dropped bool) {
+	for i := 0; i < n; i += 1 {
+		held := a.Limit()
+		a.TryAcquire(held)
+		a.Observe(rtt, dropped)
+		a.Release(held)
+	}
+}
+
+func TestAdaptive(t *testing.T) {
+	for _, algorithm := range []string{AIMD, Vegas, Gradient} {
+		a, err := NewAdaptive(&AdaptiveConfig{Algorithm: algorithm, InitialLimit: 10, MaxLimit: 100})
+		if err != nil {
+			t.Fatal(err)
+		}
+		observe(a, 20, time.Millisecond*10, false)
+		grown := a.Limit()
+		if grown <= 10 {
+			t.Fatalf("%v: limit should grow while latency is flat, got %v", algorithm, grown)
+		}
+		if algorithm == AIMD {
+			observe(a, 5, time.Millisecond*10, true)
+		} else {
+			observe(a, 20, time.Millisecond*100, false)
+		}
+		if shrunk := a.Limit(); shrunk >= grown || shrunk < 1 {
+			t.Fatalf("%v: limit should shrink under load, got %v from %v", algorithm, shrunk, grown)
+		}
+		observe(a, 1000, time.Millisecond, false)
+		if limit := a.Limit(); limit > 100 {
+			t.Fatalf("%v: limit %v over MaxLimit", algorithm, limit)
+		}
+	}
+
+	a, _ := NewAdaptive(&AdaptiveConfig{InitialLimit: 2, Timeout: 0.01})
+	failed := errors.New("failed")
+	if err := a.Do(context.Background(), 1, func() error { return failed }); err != failed {
+		t.Fatalf("Do() = %v", err)
+	}
+	limit := a.Limit()
+	if a.Used() != 0 || limit < 2 {
+		t.Fatalf("a failed call should be released and not counted as a drop, used %v, limit %v", a.Used(), limit)
+	}
+	overloaded := errors.Wrap(ERROR_Overloaded, "rejected")
+	if err := a.Do(context.Background(), 1, func() error { return overloaded }); err != overloaded {
+		t.Fatalf("Do() = %v", err)
+	}
+	if a.Used() != 0 || a.Limit() >= limit {
+		t.Fatalf("an overloaded call should be released and counted as a drop, used %v, limit %v", a.Used(), a.Limit())
+	}
+	a, _ = NewAdaptive(&AdaptiveConfig{InitialLimit: 2, Timeout: 0.01})
+	a.SetDropped(func(err error) bool { return err == failed })
+	a.Do(context.Background(), 1, func() error { return failed })
+	if a.Limit() != 1 {
+		t.Fatalf("the errors SetDropped picks should count as drops, limit %v", a.Limit())
+	}
+	a, _ = NewAdaptive(&AdaptiveConfig{InitialLimit: 2})
+	func() {
+		defer func() {
+			recover()
+		}()
+		a.Do(context.Background(), 1, func() error { panic("failed") })
+	}()
+	if a.Used() != 0 {
+		t.Fatalf("a panicking call should be released, used %v", a.Used())
+	}
+	if a, err := NewAdaptive(&AdaptiveConfig{MaxLimit: 10}); err != nil || a.Limit() != 10 {
+		t.Fatalf("the default InitialLimit should be within MaxLimit, got %v", err)
+	}
+	if a, err := NewAdaptive(&AdaptiveConfig{MinLimit: 50}); err != nil || a.Limit() != 50 {
+		t.Fatalf("the default InitialLimit should be within MinLimit, got %v", err)
+	}
+	if _, err := NewAdaptive(&AdaptiveConfig{Algorithm: "unknown"}); errors.Cause(err) != ERROR_UnknownAlgorithm {
+		t.Fatalf("NewAdaptive(unknown) = %v", err)
+	}
+	if _, err := NewAdaptive(&AdaptiveConfig{MinLimit: 10, MaxLimit: 5}); errors.Cause(err) != ERROR_InvalidConfig {
+		t.Fatalf("NewAdaptive(min > max) = %v", err)
+	}
+}
@@ -1,53 +1,142 @@
 package limitLock
 
 import (
+	"container/list"
+	"context"
 	"sync"
 )
 
+// A weighted semaphore, callers hold part of limit until they release it.
+// Waiters are served in FIFO order, so a large request isn't starved by smaller ones.
 type Lock struct {
-	_lock *sync.Mutex
+	lock *sync.Mutex
 
-	limit  int64
-	val    int64
-	locked int32
-	lock   *sync.Mutex
+	// Guarded by lock.
+	limit   int64
+	val     int64
+	waiters *list.List
+}
+
+type waiter struct {
+	n     int64
+	ready chan struct{}
 }
 
 func New(limit int64) *Lock {
 	return &Lock{
-		_lock: &sync.Mutex{},
-		limit: limit,
-		lock:  &sync.Mutex{},
+		lock:    &sync.Mutex{},
+		limit:   limit,
+		waiters: list.New(),
 	}
 }
 
-func (l *Lock) Lock(v int64) {
-	l.lock.Lock()
-	l._lock.Lock()
-	defer l._lock.Unlock()
-	l.val += v
-	l.locked = 1
+// Whether n could be taken right now, must be called with lock held.
+// A request over the limit is let through once nothing is held, rather than waiting forever.
+func (l *Lock) fits(n int64) bool {
+	return l.val+n <= l.limit || l.val == 0
 }
 
-func (l *Lock) Release(v int64) {
-	l._lock.Lock()
-	defer l._lock.Unlock()
-	l.val -= v
-	l.unlock()
+// Blocks until n is taken or ctx is done, nothing is taken if an error is returned.
+func (l *Lock) Acquire(ctx context.Context, n int64) error {
+	l.lock.Lock()
+	if l.waiters.Len() == 0 && l.fits(n) {
+		l.val += n
+		l.lock.Unlock()
+		return nil
+	}
+	w := &waiter{n: n, ready: make(chan struct{})}
+	elem := l.waiters.PushBack(w)
+	l.lock.Unlock()
+
+	select {
+	case <-w.ready:
+		return nil
+	case <-ctx.Done():
+		l.lock.Lock()
+		defer l.lock.Unlock()
+		select {
+		case <-w.ready:
+			// Taken while giving up, hand it back.
+			l.val -= n
+		default:
+			l.waiters.Remove(elem)
+		}
+		l.notify()
+		return ctx.Err()
+	}
 }
 
-func (l *Lock) Unlock() {
-	l._lock.Lock()
-	defer l._lock.Unlock()
-	l.unlock()
+// Takes n if it is available right now and nobody is waiting.
+func (l *Lock) TryAcquire(n int64) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.waiters.Len() == 0 && l.fits(n) {
+		l.val += n
+		return true
+	}
+	return false
 }
 
-func (l *Lock) unlock() {
-	if l.locked != 1 {
-		return
+// Hands n back. Releasing more than is held only empties the lock.
+func (l *Lock) Release(n int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.val -= n; l.val < 0 {
+		l.val = 0
 	}
-	if l.val < l.limit {
-		l.locked = 0
-		l.lock.Unlock()
+	l.notify()
+}
+
+// Changes the limit, waiters which fit the new limit are woken up.
+// The holders above a lowered limit keep what they took.
+func (l *Lock) SetLimit(limit int64) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	l.notify()
+}
+
+// Wakes up the waiters in order as long as they fit, must be called with lock held.
+func (l *Lock) notify() {
+	for {
+		elem := l.waiters.Front()
+		if elem == nil {
+			return
+		}
+		w := elem.Value.(*waiter)
+		if !l.fits(w.n) {
+			return
+		}
+		l.val += w.n
+		l.waiters.Remove(elem)
+		close(w.ready)
 	}
 }
+
+func (l *Lock) Limit() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.limit
+}
+
+// Returns the amount held.
+func (l *Lock) Used() int64 {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.val
+}
+
+// Returns the number of callers blocked in Acquire.
+func (l *Lock) Waiters() int {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.waiters.Len()
+}
+
+// Deprecated: use Acquire, which could be given up through its context.
+func (l *Lock) Lock(v int64) {
+	l.Acquire(context.Background(), v)
+}
+
+// Deprecated: Release hands the amount back, Unlock is a no-op kept for compatibility.
+func (l *Lock) Unlock() {}
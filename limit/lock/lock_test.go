@@ -1,6 +1,7 @@
 package limitLock
 
 import (
+	"context"
 	"fmt"
 	"testing"
 	"time"
@@ -40,3 +41,65 @@ func TestLock(t *testing.T) {
 		read(l, ch)
 	}
 }
+
+func waitFor(t *testing.T, f func() bool) {
+	deadline := time.Now().Add(time.Second * 5)
+	for !f() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSemaphore(t *testing.T) {
+	l := New(3)
+	if !l.TryAcquire(2) || l.TryAcquire(2) {
+		t.Fatal("TryAcquire should take up to the limit")
+	}
+
+	order := make(chan int, 2)
+	go func() {
+		l.Acquire(context.Background(), 3)
+		order <- 3
+	}()
+	waitFor(t, func() bool { return l.Waiters() == 1 })
+	go func() {
+		l.Acquire(context.Background(), 1)
+		order <- 1
+	}()
+	waitFor(t, func() bool { return l.Waiters() == 2 })
+	if l.TryAcquire(1) {
+		t.Fatal("TryAcquire should not jump the queue")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	if err := l.Acquire(ctx, 1); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire() = %v", err)
+	}
+	if n := l.Waiters(); n != 2 {
+		t.Fatalf("Waiters() = %v after a waiter gave up", n)
+	}
+
+	l.Release(2)
+	if first := <-order; first != 3 {
+		t.Fatalf("waiters should be served in order, got %v first", first)
+	}
+	if n := l.Used(); n != 3 {
+		t.Fatalf("Used() = %v", n)
+	}
+	l.SetLimit(4)
+	if second := <-order; second != 1 || l.Used() != 4 {
+		t.Fatalf("raising the limit should wake up the waiters, got %v, used %v", second, l.Used())
+	}
+
+	l.Release(10)
+	if n := l.Used(); n != 0 {
+		t.Fatalf("Used() = %v after releasing too much", n)
+	}
+	if !l.TryAcquire(10) {
+		t.Fatal("a request over the limit should pass once nothing is held")
+	}
+	l.Unlock()
+}
@@ -0,0 +1,243 @@
+package limitMiddleware
+
+import (
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	limitKeyed "github.com/athlum/pkg/limit/keyed"
+	"github.com/athlum/pkg/log"
+	"github.com/athlum/pkg/utils"
+	"github.com/pkg/errors"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ERROR_InvalidRoute = errors.New("invalid limit route.")
+)
+
+// Returns the key a request is limited by, requests with an empty key are not limited.
+type KeyFunc func(r *http.Request) string
+
+// Limits by the client address, proxies in front are not taken into account.
+func ByIP() KeyFunc {
+	return func(r *http.Request) string {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		return host
+	}
+}
+
+// Limits by the value of a header, e.g. an API key.
+func ByHeader(name string) KeyFunc {
+	return func(r *http.Request) string {
+		return r.Header.Get(name)
+	}
+}
+
+// Limits by the request path, every client of a path shares the same limit.
+func ByPath() KeyFunc {
+	return func(r *http.Request) string {
+		return r.URL.Path
+	}
+}
+
+type Config struct {
+	Default     *limitBucket.Config            // Limit of requests matching no route, not limited if nil.
+	Routes      map[string]*limitBucket.Config // Limits by path prefix, the longest matching prefix wins.
+	IdleTimeout float64                        // See limitKeyed.Config, applied to every route.
+	MaxKeys     int                            // See limitKeyed.Config, applied to every route.
+}
+
+// Routes need a non-empty prefix and a config, the default is kept apart from them.
+func (c *Config) Validate() error {
+	if c.Default != nil {
+		if err := c.keyed(c.Default).Validate(); err != nil {
+			return err
+		}
+	}
+	for prefix, cfg := range c.Routes {
+		if prefix == "" || cfg == nil {
+			return errors.Wrap(ERROR_InvalidRoute, prefix)
+		}
+		if err := c.keyed(cfg).Validate(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Config) keyed(cfg *limitBucket.Config) *limitKeyed.Config {
+	return &limitKeyed.Config{Default: cfg, IdleTimeout: c.IdleTimeout, MaxKeys: c.MaxKeys}
+}
+
+// Rejects requests over the limit of their route and key with 429 Too Many Requests.
+// Every response carries the X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset headers,
+// rejected ones carry Retry-After as well.
+type Middleware struct {
+	key    KeyFunc
+	update sync.Mutex // Serializes Update.
+
+	// Guarded by lock. The default registry is kept under the empty prefix.
+	lock        sync.RWMutex
+	routes      map[string]*limitKeyed.Registry
+	prefixes    []string
+	idleTimeout float64
+	maxKeys     int
+}
+
+func New(key KeyFunc, cfg *Config) (*Middleware, error) {
+	m := &Middleware{
+		key:         key,
+		idleTimeout: cfg.IdleTimeout,
+		maxKeys:     cfg.MaxKeys,
+	}
+	if err := m.Update(cfg); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// Applies the route configs to the live limiters, routes which are gone are dropped.
+// The limiters of every route are rebuilt if IdleTimeout or MaxKeys changed.
+// Nothing is changed if any of the configs is invalid.
+func (m *Middleware) Update(cfg *Config) error {
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+	configs := make(map[string]*limitBucket.Config, len(cfg.Routes)+1)
+	for prefix, c := range cfg.Routes {
+		configs[prefix] = c
+	}
+	if cfg.Default != nil {
+		configs[""] = cfg.Default
+	}
+
+	m.update.Lock()
+	defer m.update.Unlock()
+	m.lock.RLock()
+	old := m.routes
+	rebuild := m.idleTimeout != cfg.IdleTimeout || m.maxKeys != cfg.MaxKeys
+	m.lock.RUnlock()
+
+	// Registries are built before anything is swapped in, so a failure leaves the live ones untouched.
+	routes := make(map[string]*limitKeyed.Registry, len(configs))
+	built := make([]*limitKeyed.Registry, 0, len(configs))
+	for prefix, c := range configs {
+		if r, ok := old[prefix]; ok && !rebuild {
+			routes[prefix] = r
+			continue
+		}
+		r, err := limitKeyed.New(cfg.keyed(c))
+		if err != nil {
+			for _, r := range built {
+				r.Close()
+			}
+			return err
+		}
+		routes[prefix] = r
+		built = append(built, r)
+	}
+	prefixes := make([]string, 0, len(routes))
+	for prefix := range routes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i]) > len(prefixes[j])
+	})
+
+	m.lock.Lock()
+	m.routes, m.prefixes = routes, prefixes
+	m.idleTimeout, m.maxKeys = cfg.IdleTimeout, cfg.MaxKeys
+	m.lock.Unlock()
+	for prefix, r := range old {
+		if routes[prefix] != r {
+			r.Close()
+		} else {
+			r.SetDefault(configs[prefix])
+		}
+	}
+	return nil
+}
+
+// Whether path is under prefix, on a path segment boundary: "/api" matches "/api/users" but not "/apiary".
+func matches(path, prefix string) bool {
+	if !strings.HasPrefix(path, prefix) {
+		return false
+	}
+	return len(path) == len(prefix) || prefix == "" || strings.HasSuffix(prefix, "/") || path[len(prefix)] == '/'
+}
+
+func (m *Middleware) route(path string) (*limitKeyed.Registry, bool) {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	for _, prefix := range m.prefixes {
+		if matches(path, prefix) {
+			return m.routes[prefix], true
+		}
+	}
+	return nil, false
+}
+
+func (m *Middleware) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !m.allow(w, r) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Writes the rate limit headers, and the 429 response if the request is rejected.
+func (m *Middleware) allow(w http.ResponseWriter, r *http.Request) bool {
+	reg, ok := m.route(r.URL.Path)
+	if !ok {
+		return true
+	}
+	key := m.key(r)
+	if key == "" {
+		return true
+	}
+	l, err := reg.Get(key)
+	if err != nil {
+		log.With(log.Type("limitMiddleware")).Errorf("Limiter of %v failed: %v", key, err.Error())
+		return true
+	}
+	allowed := l.TryAcquire(1)
+	s := l.State()
+	h := w.Header()
+	h.Set("X-RateLimit-Limit", strconv.Itoa(s.Limit))
+	h.Set("X-RateLimit-Remaining", strconv.Itoa(s.Remaining))
+	h.Set("X-RateLimit-Reset", seconds(s.Reset))
+	if allowed {
+		return true
+	}
+	h.Set("Retry-After", seconds(s.Next))
+	h.Set("Content-Type", "application/json")
+	code, body := utils.TooManyRequests()
+	w.WriteHeader(code)
+	w.Write(body)
+	return false
+}
+
+// Rounds d up to whole seconds.
+func seconds(d time.Duration) string {
+	return strconv.FormatInt(int64((d+time.Second-1)/time.Second), 10)
+}
+
+func (m *Middleware) Close() {
+	m.update.Lock()
+	defer m.update.Unlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, r := range m.routes {
+		r.Close()
+	}
+	m.routes = make(map[string]*limitKeyed.Registry)
+	m.prefixes = nil
+}
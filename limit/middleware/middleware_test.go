@@ -0,0 +1,85 @@
+package limitMiddleware
+
+import (
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/pkg/errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestMiddleware(t *testing.T) {
+	m, err := New(ByHeader("X-Api-Key"), &Config{
+		Routes: map[string]*limitBucket.Config{
+			"/api":      {Limit: 2, Interval: 10},
+			"/api/bulk": {Limit: 1, Interval: 10},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	h := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	do := func(path, key string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set("X-Api-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := do("/api/users", "a"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "2" || w.Header().Get("X-RateLimit-Remaining") != "1" {
+		t.Fatalf("first request: %v %v", w.Code, w.Header())
+	}
+	do("/api/users", "a")
+	w := do("/api/users", "a")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "5" || w.Header().Get("X-RateLimit-Reset") != "10" {
+		t.Fatalf("third request: %v %v", w.Code, w.Header())
+	}
+	if w := do("/api/users", "b"); w.Code != http.StatusOK {
+		t.Fatalf("another key should not be limited: %v", w.Code)
+	}
+	if w := do("/api/bulk", "c"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "1" {
+		t.Fatalf("the longest prefix should win: %v %v", w.Code, w.Header())
+	}
+	if w := do("/health", "a"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatalf("requests matching no route should not be limited: %v %v", w.Code, w.Header())
+	}
+	if w := do("/apiary", "a"); w.Code != http.StatusOK || w.Header().Get("X-RateLimit-Limit") != "" {
+		t.Fatalf("routes should match on a path segment boundary: %v %v", w.Code, w.Header())
+	}
+	if w := do("/api", "d"); w.Header().Get("X-RateLimit-Limit") != "2" {
+		t.Fatalf("a route should match its own path: %v", w.Header())
+	}
+
+	if err := m.Update(&Config{Routes: map[string]*limitBucket.Config{"/api": {Limit: 0, Interval: 10}}}); err == nil {
+		t.Fatal("invalid configs should be rejected")
+	}
+	for _, routes := range []map[string]*limitBucket.Config{{"/x": nil}, {"": {Limit: 1, Interval: 1}}} {
+		if err := m.Update(&Config{Routes: routes}); errors.Cause(err) != ERROR_InvalidRoute {
+			t.Fatalf("Update(%v) = %v", routes, err)
+		}
+	}
+	if err := m.Update(&Config{Routes: map[string]*limitBucket.Config{"/api": {Limit: 5, Interval: 10}}}); err != nil {
+		t.Fatal(err)
+	}
+	if w := do("/api/users", "a"); w.Header().Get("X-RateLimit-Limit") != "5" {
+		t.Fatalf("the live limiter should be updated: %v", w.Header())
+	}
+	if w := do("/api/bulk", "c"); w.Header().Get("X-RateLimit-Limit") != "5" {
+		t.Fatalf("removed routes should fall back to the others: %v", w.Header())
+	}
+
+	live, _ := m.route("/api")
+	if err := m.Update(&Config{Routes: map[string]*limitBucket.Config{"/api": {Limit: 5, Interval: 10}}, MaxKeys: 1}); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"x", "y", "z"} {
+		do("/api/users", key)
+	}
+	if r, _ := m.route("/api"); r == live || r.Count() > 1 {
+		t.Fatal("the routes should be rebuilt with the new MaxKeys")
+	}
+}
@@ -0,0 +1,93 @@
+package limitSource
+
+import (
+	"github.com/athlum/pkg/exitChan"
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/athlum/pkg/log"
+	"github.com/athlum/pkg/utils"
+	"os"
+	"time"
+)
+
+const DefaultPollInterval = 5.0
+
+// Reads a JSON config from a file, again whenever its modification time or size changes.
+type FileSource struct {
+	path string
+	feed *feed
+	stop *exitChan.ExitChan
+	done chan struct{}
+
+	mtime time.Time
+	size  int64
+}
+
+// Reads the config at path and polls it every interval seconds, DefaultPollInterval if 0.
+// It fails if the file has no valid config to start with.
+func NewFileSource(path string, interval float64) (*FileSource, error) {
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	s := &FileSource{
+		path: path,
+		feed: newFeed(path),
+		stop: exitChan.NewExitChan(),
+		done: make(chan struct{}),
+	}
+	b, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.feed.offer(b); err != nil {
+		return nil, err
+	}
+	go s.loop(utils.Duration(interval))
+	return s, nil
+}
+
+// Returns the content of the file, or nil if it is unchanged since the last read.
+func (s *FileSource) read() ([]byte, error) {
+	fi, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.ModTime().Equal(s.mtime) && fi.Size() == s.size {
+		return nil, nil
+	}
+	b, err := os.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	// A rejected file isn't decoded again until it changes.
+	s.mtime, s.size = fi.ModTime(), fi.Size()
+	return b, nil
+}
+
+func (s *FileSource) loop(interval time.Duration) {
+	defer close(s.done)
+	defer close(s.feed.ch)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-s.stop.Chan():
+			return
+		case <-t.C:
+			b, err := s.read()
+			if err != nil {
+				log.With(log.Type("limitSource"), log.String("source", s.path)).Errorf("Read failed: %v", err.Error())
+			} else if b != nil {
+				s.feed.offer(b)
+			}
+		}
+	}
+}
+
+func (s *FileSource) Configs() <-chan *limitBucket.Config {
+	return s.feed.ch
+}
+
+func (s *FileSource) Close() {
+	s.stop.Close()
+	<-s.done
+}
@@ -0,0 +1,81 @@
+package limitSource
+
+import (
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/athlum/pkg/log"
+	"github.com/pkg/errors"
+)
+
+// Anything a config could be applied to, every limitBucket.Limiter is.
+type Updater interface {
+	Update(cfg *limitBucket.Config)
+}
+
+// A stream of configs read from somewhere. Only valid configs are delivered, invalid ones are
+// logged and skipped so the last good config stays in effect.
+type Source interface {
+	// Returns the configs read, the channel is closed after Close.
+	// Only the latest config is kept while the reader is behind.
+	Configs() <-chan *limitBucket.Config
+	Close()
+}
+
+// Applies every config of src to u until src is closed.
+func Apply(src Source, u Updater) {
+	go func() {
+		for cfg := range src.Configs() {
+			u.Update(cfg)
+		}
+	}()
+}
+
+func decode(b []byte) (*limitBucket.Config, error) {
+	cfg, err := limitBucket.ConfigFromJSON(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decode limit config:")
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Delivers the configs of a source, the last one sent is kept to skip reads which didn't change it.
+type feed struct {
+	name string
+	ch   chan *limitBucket.Config
+	last *limitBucket.Config
+}
+
+func newFeed(name string) *feed {
+	return &feed{
+		name: name,
+		ch:   make(chan *limitBucket.Config, 1),
+	}
+}
+
+// Decodes b and sends it if it is valid and changed, must be called by a single goroutine.
+func (f *feed) offer(b []byte) error {
+	cfg, err := decode(b)
+	if err != nil {
+		log.With(log.Type("limitSource"), log.String("source", f.name)).Errorf("Rejected config: %v", err.Error())
+		return err
+	}
+	if f.last != nil && *f.last == *cfg {
+		return nil
+	}
+	f.last = cfg
+	for {
+		select {
+		case f.ch <- cfg:
+			log.With(log.Type("limitSource"), log.String("source", f.name)).Infof("Config changed: %#v", *cfg)
+			return nil
+		default:
+		}
+		// The reader is behind, replace the pending config.
+		select {
+		case <-f.ch:
+		default:
+		}
+	}
+}
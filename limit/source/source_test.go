@@ -0,0 +1,125 @@
+package limitSource
+
+import (
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/athlum/pkg/log"
+	"github.com/athlum/pkg/zk"
+	"github.com/athlum/pkg/zk/zktest"
+	gozk "github.com/samuel/go-zookeeper/zk"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func init() {
+	log.Initialize(&log.Config{Disable: true})
+}
+
+func expectLimit(t *testing.T, e *limitBucket.Engine, limit int) {
+	deadline := time.Now().Add(time.Second * 5)
+	for e.Config().Limit != limit {
+		if time.Now().After(deadline) {
+			t.Fatalf("Config().Limit = %v, expect %v", e.Config().Limit, limit)
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestFileSource(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "limit.json")
+	version := time.Now()
+	write := func(s string) {
+		if err := os.WriteFile(path, []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+		version = version.Add(time.Second)
+		os.Chtimes(path, version, version)
+	}
+	write(`{"Limit": 0, "Interval": 1}`)
+	if _, err := NewFileSource(path, 0.01); err == nil {
+		t.Fatal("an invalid config to start with should fail")
+	}
+
+	write(`{"Limit": 1, "Interval": 1}`)
+	src, err := NewFileSource(path, 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := limitBucket.New(&limitBucket.Config{Limit: 100, Interval: 1})
+	defer e.Close()
+	Apply(src, e)
+	expectLimit(t, e, 1)
+
+	write(`{"Limit": 2, "Interval": 1}`)
+	expectLimit(t, e, 2)
+	write(`{"Limit": 3, "Interval": -1}`)
+	time.Sleep(time.Millisecond * 50)
+	write(`not json`)
+	time.Sleep(time.Millisecond * 50)
+	expectLimit(t, e, 2)
+	write(`{"Limit": 4, "Interval": 1}`)
+	expectLimit(t, e, 4)
+
+	src.Close()
+	if _, ok := <-src.Configs(); ok {
+		t.Fatal("Configs should be closed after Close")
+	}
+}
+
+func TestZKSource(t *testing.T) {
+	server := zktest.NewServer()
+	z, err := zk.NewZKWithDialer(&zk.Config{RootPath: "/"}, server.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := z.Session().Create("/limit", []byte(`{"Limit": 1, "Interval": 1}`), 0, gozk.WorldACL(gozk.PermAll)); err != nil {
+		t.Fatal(err)
+	}
+	src, err := NewZKSource(z, "/limit", 0.01)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := limitBucket.New(&limitBucket.Config{Limit: 100, Interval: 1})
+	defer e.Close()
+	Apply(src, e)
+	expectLimit(t, e, 1)
+
+	for _, val := range []string{`{"Limit": 2, "Interval": 1}`, `{"Limit": -2}`, `{"Limit": 3, "Interval": 1}`} {
+		if _, err := z.Session().Set("/limit", []byte(val), -1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectLimit(t, e, 3)
+	if _, err := z.Session().Set("/limit", []byte(`{"Limit": 3, "Algorithm": "unknown"}`), -1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	expectLimit(t, e, 3)
+
+	// The last config is kept while the node is gone, and the node is watched again once it's back.
+	if err := z.Session().Delete("/limit", -1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 50)
+	expectLimit(t, e, 3)
+	if _, err := z.Session().Create("/limit", []byte(`{"Limit": 5, "Interval": 1}`), 0, gozk.WorldACL(gozk.PermAll)); err != nil {
+		t.Fatal(err)
+	}
+	expectLimit(t, e, 5)
+	if _, err := z.Session().Set("/limit", []byte(`{"Limit": 6, "Interval": 1}`), -1); err != nil {
+		t.Fatal(err)
+	}
+	expectLimit(t, e, 6)
+	src.Close()
+
+	// A node nobody reads the events of doesn't hold the shutdown up.
+	tree, err := z.WatchNode("/limit", "", nil, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go tree.Init()
+	if err := z.Shutdown(time.Second); err != nil {
+		t.Fatalf("Shutdown() = %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package limitSource
+
+import (
+	"github.com/athlum/pkg/exitChan"
+	limitBucket "github.com/athlum/pkg/limit/bucket"
+	"github.com/athlum/pkg/log"
+	"github.com/athlum/pkg/utils"
+	"github.com/athlum/pkg/zk"
+	"sync"
+	"time"
+)
+
+const DefaultFlushInterval = 30.0
+
+// Reads a JSON config from the value of a zk node, again whenever it changes.
+// Once the node is deleted the last config is kept, and the node is polled for every interval
+// until it's created again. Only one TreeNode of a path is allowed per ZK,
+// so the node should not be watched otherwise.
+type ZKSource struct {
+	zk       *zk.ZK
+	path     string
+	interval time.Duration
+	events   chan *zk.NodeEvent // Shared by every TreeNode of the source.
+	feed     *feed
+	stop     *exitChan.ExitChan
+	quit     chan struct{}
+	done     chan struct{}
+	closed   *sync.Once
+
+	lock sync.Mutex
+	tree *zk.TreeNode // Guarded by lock, replaced once the node is created again.
+}
+
+// Watches the node at path, which is read in full every interval seconds as well,
+// DefaultFlushInterval if 0. An invalid value to start with is only logged.
+func NewZKSource(z *zk.ZK, path string, interval float64) (*ZKSource, error) {
+	if interval <= 0 {
+		interval = DefaultFlushInterval
+	}
+	tree, err := z.WatchNode(path, "", nil, utils.Duration(interval))
+	if err != nil {
+		return nil, err
+	}
+	s := &ZKSource{
+		zk:       z,
+		path:     path,
+		interval: utils.Duration(interval),
+		events:   tree.Event,
+		tree:     tree,
+		feed:     newFeed(path),
+		stop:     exitChan.NewExitChan(),
+		quit:     make(chan struct{}),
+		done:     make(chan struct{}),
+		closed:   &sync.Once{},
+	}
+	go s.loop()
+	if err := tree.Init(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *ZKSource) loop() {
+	defer close(s.done)
+	defer close(s.feed.ch)
+	var retry <-chan time.Time
+	var ticker *time.Ticker
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case <-retry:
+			exists, _, err := s.zk.Session().Exists(s.path)
+			if err != nil || !exists {
+				continue
+			}
+			ticker.Stop()
+			ticker, retry = nil, nil
+			go s.rewatch()
+		case e := <-s.events:
+			if e.Path != s.path {
+				continue
+			}
+			switch e.Event {
+			case zk.NodeNew, zk.NodeUpdate:
+				s.feed.offer(e.Val)
+			case zk.NodeRemoved:
+				if s.stop.Exited() || ticker != nil {
+					continue
+				}
+				log.With(log.Type("limitSource"), log.String("source", s.path)).Errorf("Config node removed, the last config is kept until it comes back.")
+				ticker = time.NewTicker(s.interval)
+				retry = ticker.C
+			}
+		}
+	}
+}
+
+// Watches the node again once it's created again, its events go to the same loop.
+func (s *ZKSource) rewatch() {
+	s.lock.Lock()
+	if s.stop.Exited() {
+		s.lock.Unlock()
+		return
+	}
+	tree, err := s.zk.WatchNode(s.path, "", nil, s.interval)
+	if err != nil {
+		s.lock.Unlock()
+		log.With(log.Type("limitSource"), log.String("source", s.path)).Errorf("Watch failed: %v", err.Error())
+		return
+	}
+	tree.Event = s.events
+	s.tree = tree
+	s.lock.Unlock()
+	// A failed init is cleared, which emits the removal and starts polling again.
+	if err := tree.Init(); err != nil {
+		log.With(log.Type("limitSource"), log.String("source", s.path)).Errorf("Init failed: %v", err.Error())
+		if err := tree.Clear(); err != nil {
+			log.With(log.Type("limitSource"), log.String("source", s.path)).Errorf("Clear failed: %v", err.Error())
+		}
+	}
+}
+
+func (s *ZKSource) Configs() <-chan *limitBucket.Config {
+	return s.feed.ch
+}
+
+func (s *ZKSource) Close() {
+	s.closed.Do(func() {
+		s.lock.Lock()
+		s.stop.Close()
+		tree := s.tree
+		s.lock.Unlock()
+		// Clearing the tree emits its removal, so it's done before the loop quits.
+		if err := tree.Clear(); err != nil {
+			log.With(log.Type("limitSource"), log.String("source", s.path)).Errorf("Clear failed: %v", err.Error())
+		}
+		close(s.quit)
+		<-s.done
+	})
+}
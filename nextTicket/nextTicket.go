@@ -1,22 +1,60 @@
 package nextTicket
 
 import (
+	"context"
+	"github.com/athlum/pkg/clock"
 	"github.com/pkg/errors"
+	"sync"
 	"time"
 )
 
 var (
 	Error_InvalidDuration = errors.New("Invalid duration.")
-	Error_NextTimeout     = errors.New("Push next timeout.")
+	Error_NextTimeout     = errors.New("Push next timeout.") // Deprecated: Reset and Next never time out.
 )
 
+// Delivers the ticks of a Schedule on C. Like time.Ticker, a tick is dropped if C still
+// holds the previous one, and the schedule could be changed at any time.
 type Ticket struct {
-	C    <-chan time.Time
-	t    chan time.Duration
-	stop chan int
-	d    time.Duration
+	C      <-chan time.Time
+	clock  clock.Clock
+	ctx    context.Context
+	cancel context.CancelFunc
+	change chan struct{}
+	done   chan struct{}
+
+	// Guarded by lock. sched is nil while only a single tick at next is due.
+	lock  sync.Mutex
+	sched Schedule
+	next  time.Time
+}
+
+// Starts a Ticket following s until ctx is done or Stop is called. s could be nil, nothing
+// fires until Reset or SetSchedule then.
+func New(ctx context.Context, s Schedule) *Ticket {
+	return NewWithClock(ctx, clock.Real, s)
+}
+
+// Same as New, with the ticks driven by clk.
+func NewWithClock(ctx context.Context, clk clock.Clock, s Schedule) *Ticket {
+	ctx, cancel := context.WithCancel(ctx)
+	c := make(chan time.Time, 1)
+	t := &Ticket{
+		C:      c,
+		clock:  clock.Or(clk),
+		ctx:    ctx,
+		cancel: cancel,
+		change: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if s != nil {
+		t.SetSchedule(s)
+	}
+	go t.loop(c)
+	return t
 }
 
+// Starts a Ticket firing every d, or one which waits for Next if d is 0.
 func NewTicket(ds ...time.Duration) (*Ticket, error) {
 	var d time.Duration
 	if len(ds) > 0 {
@@ -25,51 +63,130 @@ func NewTicket(ds ...time.Duration) (*Ticket, error) {
 	if d < 0 {
 		return nil, Error_InvalidDuration
 	}
-	c := make(chan time.Time, 1)
-	t := &Ticket{
-		C:    c,
-		t:    make(chan time.Duration, 1),
-		stop: make(chan int),
-	}
+	t := New(context.Background(), nil)
 	if d > 0 {
-		t.Next(d)
+		t.Reset(d)
 	}
-	go t.loop(c)
 	return t, nil
 }
 
-func (t *Ticket) Next(d time.Duration) error {
+// Fires after d and every d from then on. With d of 0, it fires once right away
+// and waits for the next Reset or SetSchedule.
+func (t *Ticket) Reset(d time.Duration) error {
 	if d < 0 {
 		return Error_InvalidDuration
 	}
-	select {
-	case t.t <- d:
-		break
-	case <-time.After(time.Millisecond * 10):
-		return Error_NextTimeout
+	t.lock.Lock()
+	if d > 0 {
+		t.sched = Every(d)
+	} else {
+		t.sched = nil
 	}
+	t.next = t.clock.Now().Add(d)
+	t.lock.Unlock()
+	t.changed()
 	return nil
 }
 
+// Deprecated: use Reset, Next is kept for compatibility and never times out.
+func (t *Ticket) Next(d time.Duration) error {
+	return t.Reset(d)
+}
+
+// Switches to s, starting over from now. A nil s stops ticking until the next Reset or SetSchedule.
+func (t *Ticket) SetSchedule(s Schedule) {
+	t.lock.Lock()
+	if s == nil {
+		t.sched = nil
+		t.next = time.Time{}
+	} else {
+		if r, ok := s.(resetter); ok {
+			r.reset()
+		}
+		t.sched = s
+		t.next = s.Next(t.clock.Now())
+	}
+	t.lock.Unlock()
+	t.changed()
+}
+
+func (t *Ticket) changed() {
+	select {
+	case t.change <- struct{}{}:
+	default:
+	}
+}
+
+// Returns the time of the next tick, zero if nothing is due.
+func (t *Ticket) NextTick() time.Time {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.next
+}
+
 func (t *Ticket) loop(c chan time.Time) {
+	defer close(t.done)
+	timer := t.clock.NewTimer(0)
+	stopTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C():
+			default:
+			}
+		}
+	}
+	stopTimer()
+	defer timer.Stop()
+	arm := func() {
+		stopTimer()
+		t.lock.Lock()
+		next := t.next
+		t.lock.Unlock()
+		if !next.IsZero() {
+			timer.Reset(next.Sub(t.clock.Now()))
+		}
+	}
+	arm()
 	for {
 		select {
-		case <-t.stop:
+		case <-t.ctx.Done():
 			return
-		case d := <-t.t:
-			t.d = d
-		case v := <-time.After(t.d):
+		case <-t.change:
+			arm()
+		case now := <-timer.C():
+			t.lock.Lock()
+			if t.next.IsZero() || now.Before(t.next) {
+				// Fired for a tick which was changed meanwhile.
+				t.lock.Unlock()
+				arm()
+				continue
+			}
 			select {
-			case <-t.stop:
-				return
-			case c <- v:
-				break
+			case c <- now:
+			default:
+			}
+			if t.sched != nil {
+				// Catch up without firing for ticks missed meanwhile.
+				next := t.sched.Next(t.next)
+				for !next.IsZero() && !next.After(now) {
+					next = t.sched.Next(next)
+				}
+				t.next = next
+			} else {
+				t.next = time.Time{}
 			}
+			t.lock.Unlock()
+			arm()
 		}
 	}
 }
 
+// Returns a channel which is closed once the Ticket stopped.
+func (t *Ticket) Done() <-chan struct{} {
+	return t.done
+}
+
+// Stops the Ticket, it's safe to call more than once.
 func (t *Ticket) Stop() {
-	close(t.stop)
-	close(t.t)
+	t.cancel()
 }
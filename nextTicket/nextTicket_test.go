@@ -1,7 +1,10 @@
 package nextTicket
 
 import (
+	"context"
 	"fmt"
+	"github.com/athlum/pkg/clock"
+	"github.com/pkg/errors"
 	"net/http"
 	_ "net/http/pprof"
 	"testing"
@@ -15,29 +18,141 @@ func init() {
 }
 
 func TestTicket(t *testing.T) {
-	ticket, err := NewTicket(time.Second * 3)
+	clk := clock.NewFake(time.Now())
+	ticket := NewWithClock(context.Background(), clk, nil)
+	defer ticket.Stop()
+	for i := 0; i < 100; i += 1 {
+		expect := clk.Now()
+		if i%2 == 0 {
+			ticket.Next(time.Second)
+			clk.Advance(time.Second)
+			expect = expect.Add(time.Second)
+		} else {
+			ticket.Next(0)
+		}
+		if now := <-ticket.C; !now.Equal(expect) {
+			t.Fatalf("tick %v fired at %v, expect %v", i, now, expect)
+		}
+	}
+
+	// Ticks missed while nobody reads C are dropped.
+	ticket.Reset(time.Second)
+	clk.Advance(time.Second * 5)
+	for !ticket.NextTick().Equal(clk.Now().Add(time.Second)) {
+		time.Sleep(time.Millisecond)
+	}
+	<-ticket.C
+	select {
+	case <-ticket.C:
+		t.Fatal("missed ticks should be dropped")
+	default:
+	}
+}
+
+func TestReset(t *testing.T) {
+	ticket, err := NewTicket()
 	if err != nil {
 		panic(err)
 	}
-	defer ticket.Stop()
-	i := 0
-	// var init bool
-	for {
-		fmt.Println("1")
-		select {
-		case now := <-ticket.C:
-			fmt.Println("2")
-			if i >= 100 {
-				return
-			}
-			i += 1
-			if i%2 != 0 {
-				ticket.Next(time.Second)
-				fmt.Println("c")
-				continue
-			}
-			fmt.Println(now, time.Now())
-			ticket.Next(0)
+	select {
+	case <-ticket.C:
+		t.Fatal("a Ticket without duration should wait for Reset")
+	case <-time.After(time.Millisecond * 20):
+	}
+	for i := 0; i < 100; i += 1 {
+		if err := ticket.Next(time.Millisecond * 5); err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+	}
+	<-ticket.C
+	<-ticket.C
+	ticket.Reset(0)
+	// A tick of the previous schedule may still be held by C.
+	select {
+	case <-ticket.C:
+	default:
+	}
+	<-ticket.C
+	select {
+	case <-ticket.C:
+		t.Fatal("Reset(0) should fire only once")
+	case <-time.After(time.Millisecond * 20):
+	}
+	ticket.Reset(time.Millisecond * 5)
+	ticket.SetSchedule(nil)
+	select {
+	case <-ticket.C:
+	default:
+	}
+	select {
+	case <-ticket.C:
+		t.Fatal("SetSchedule(nil) should stop ticking")
+	case <-time.After(time.Millisecond * 20):
+	}
+	if !ticket.NextTick().IsZero() {
+		t.Fatalf("NextTick() = %v after SetSchedule(nil)", ticket.NextTick())
+	}
+	if err := ticket.Reset(-1); err != Error_InvalidDuration {
+		t.Fatalf("Reset(-1) = %v", err)
+	}
+	ticket.Stop()
+	ticket.Stop()
+	<-ticket.Done()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ticket = New(ctx, Every(time.Millisecond))
+	<-ticket.C
+	cancel()
+	<-ticket.Done()
+}
+
+func TestSchedule(t *testing.T) {
+	start := time.Date(2024, 3, 1, 17, 50, 30, 0, time.UTC)
+	intervals := func(s Schedule, n int) []time.Duration {
+		var ds []time.Duration
+		prev := start
+		for i := 0; i < n; i += 1 {
+			next := s.Next(prev)
+			ds = append(ds, next.Sub(prev))
+			prev = next
+		}
+		return ds
+	}
+	ms := time.Millisecond
+	if ds := fmt.Sprint(intervals(Backoff(10*ms, 30*ms), 4)); ds != "[10ms 20ms 30ms 30ms]" {
+		t.Fatalf("Backoff intervals %v", ds)
+	}
+	if ds := fmt.Sprint(intervals(Exponential(10*ms, 50*ms, 2), 4)); ds != "[10ms 20ms 40ms 50ms]" {
+		t.Fatalf("Exponential intervals %v", ds)
+	}
+	for _, d := range intervals(WithJitter(Every(100*ms), 0.1), 100) {
+		if d < 90*ms || d > 110*ms {
+			t.Fatalf("jittered interval %v out of range", d)
+		}
+	}
+	if !Every(0).Next(start).IsZero() {
+		t.Fatal("Every(0) should never tick")
+	}
+
+	for expr, expect := range map[string]string{
+		"*/15 9-17 * * mon-fri": "2024-03-04 09:00", // Friday evening to Monday morning.
+		"0 0 29 2 *":            "2028-02-29 00:00", // The leap day of 2024 has passed.
+		"@hourly":               "2024-03-01 18:00",
+		"55 17 1,15 * *":        "2024-03-01 17:55",
+		"0 12 13 * 5":           "2024-03-08 12:00", // Any Friday or the 13th.
+		"0 0 * * 7":             "2024-03-03 00:00",
+	} {
+		s, err := Cron(expr)
+		if err != nil {
+			t.Fatalf("Cron(%v) = %v", expr, err)
+		}
+		if next := s.Next(start).Format("2006-01-02 15:04"); next != expect {
+			t.Fatalf("Cron(%v).Next() = %v, expect %v", expr, next, expect)
+		}
+	}
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := Cron(expr); errors.Cause(err) != Error_InvalidCron {
+			t.Fatalf("Cron(%q) = %v", expr, err)
 		}
 	}
 }
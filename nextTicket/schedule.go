@@ -0,0 +1,125 @@
+package nextTicket
+
+import (
+	"math/rand"
+	"time"
+)
+
+// Decides when a Ticket fires. Next returns the time of the tick following prev,
+// or the zero Time once there are no more ticks. Schedules are used by one Ticket at a time.
+type Schedule interface {
+	Next(prev time.Time) time.Time
+}
+
+type every time.Duration
+
+// Ticks every d, never if d isn't positive.
+func Every(d time.Duration) Schedule {
+	return every(d)
+}
+
+func (e every) Next(prev time.Time) time.Time {
+	if e <= 0 {
+		return time.Time{}
+	}
+	return prev.Add(time.Duration(e))
+}
+
+// Grows the interval after every tick, it is reset by the Ticket when the schedule is set again.
+type growing struct {
+	next    func(cur time.Duration) time.Duration
+	initial time.Duration
+	cur     time.Duration
+}
+
+func (g *growing) Next(prev time.Time) time.Time {
+	if g.initial <= 0 {
+		return time.Time{}
+	}
+	if g.cur == 0 {
+		g.cur = g.initial
+	} else {
+		g.cur = g.next(g.cur)
+	}
+	return prev.Add(g.cur)
+}
+
+func (g *growing) reset() {
+	g.cur = 0
+}
+
+// Ticks after interval, then waits interval longer after every tick up to max, like utils.Backoff.
+func Backoff(interval, max time.Duration) Schedule {
+	if max < interval {
+		max = interval
+	}
+	return &growing{
+		initial: interval,
+		next: func(cur time.Duration) time.Duration {
+			if cur += interval; cur > max {
+				return max
+			}
+			return cur
+		},
+	}
+}
+
+// Ticks after initial, then multiplies the interval by factor after every tick up to max.
+func Exponential(initial, max time.Duration, factor float64) Schedule {
+	if max < initial {
+		max = initial
+	}
+	if factor < 1 {
+		factor = 1
+	}
+	return &growing{
+		initial: initial,
+		next: func(cur time.Duration) time.Duration {
+			if cur = time.Duration(float64(cur) * factor); cur > max {
+				return max
+			}
+			return cur
+		},
+	}
+}
+
+// Resets the state of a schedule, so it starts over.
+type resetter interface {
+	reset()
+}
+
+type jitter struct {
+	Schedule
+	ratio float64
+	rand  *rand.Rand
+}
+
+// Moves every tick of s by up to ratio of its interval, earlier or later, so tickers
+// started together spread out. ratio is kept within [0, 1).
+func WithJitter(s Schedule, ratio float64) Schedule {
+	if ratio < 0 {
+		ratio = 0
+	} else if ratio >= 1 {
+		ratio = 0.99
+	}
+	return &jitter{
+		Schedule: s,
+		ratio:    ratio,
+		rand:     rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (j *jitter) Next(prev time.Time) time.Time {
+	next := j.Schedule.Next(prev)
+	if next.IsZero() {
+		return next
+	}
+	r := j.rand.Float64()*2 - 1
+	return next.Add(time.Duration(float64(next.Sub(prev)) * j.ratio * r))
+}
+
+func (j *jitter) reset() {
+	if r, ok := j.Schedule.(resetter); ok {
+		r.reset()
+	}
+}
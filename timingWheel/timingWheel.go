@@ -0,0 +1,221 @@
+// A hierarchical timing wheel, so a large number of delayed tasks share a single goroutine
+// instead of a timer each.
+package timingWheel
+
+import (
+	"container/list"
+	"github.com/athlum/pkg/clock"
+	"github.com/athlum/pkg/exitChan"
+	"github.com/pkg/errors"
+	"math"
+	"sync"
+	"time"
+)
+
+var (
+	ERROR_InvalidConfig = errors.New("invalid timing wheel config.")
+)
+
+type task struct {
+	expire int64 // In ticks since the wheel started.
+	f      func()
+
+	// Guarded by the lock of the wheel, nil once the task left its bucket.
+	bucket *list.List
+	elem   *list.Element
+}
+
+// A task scheduled on a Wheel.
+type Handle struct {
+	w *Wheel
+	t *task
+}
+
+// Stops the task, returns false if it already ran, is running, or was cancelled.
+func (h Handle) Cancel() bool {
+	if h.t == nil {
+		return false
+	}
+	h.w.lock.Lock()
+	defer h.w.lock.Unlock()
+	if h.t.elem == nil {
+		return false
+	}
+	h.w.remove(h.t)
+	return true
+}
+
+// Level l of the wheel has slots buckets spanning slots^l ticks each, tasks move down
+// a level whenever the wheel reaches the bucket they are in.
+type Wheel struct {
+	clock clock.Clock
+	tick  time.Duration
+	slots int64
+	start time.Time
+	stop  *exitChan.ExitChan
+	done  chan struct{}
+
+	// Guarded by lock.
+	lock    sync.Mutex
+	current int64 // Ticks passed since start.
+	levels  [][]*list.List
+	spans   []int64
+	count   int
+}
+
+// Starts a wheel which fires tasks with a resolution of tick, on a level 0 of slots buckets.
+func New(tick time.Duration, slots int) (*Wheel, error) {
+	return NewWithClock(clock.Real, tick, slots)
+}
+
+// Same as New, with the ticks driven by clk.
+func NewWithClock(clk clock.Clock, tick time.Duration, slots int) (*Wheel, error) {
+	if tick <= 0 || slots < 2 {
+		return nil, errors.Wrapf(ERROR_InvalidConfig, "tick %v, slots %v", tick, slots)
+	}
+	clk = clock.Or(clk)
+	w := &Wheel{
+		clock: clk,
+		tick:  tick,
+		slots: int64(slots),
+		start: clk.Now(),
+		stop:  exitChan.NewExitChan(),
+		done:  make(chan struct{}),
+	}
+	// Created before the loop starts, so the clock moving right after New isn't missed.
+	go w.loop(clk.NewTicker(tick))
+	return w, nil
+}
+
+// Runs f once d passed, rounded up to the tick. f runs on the goroutine driving the wheel,
+// so it should return quickly and start a goroutine for anything longer.
+// Nothing runs if the wheel is closed.
+func (w *Wheel) Schedule(d time.Duration, f func()) Handle {
+	ticks := int64(math.Ceil(float64(d) / float64(w.tick)))
+	if ticks < 1 {
+		ticks = 1
+	}
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	if w.stop.Exited() {
+		return Handle{}
+	}
+	if ticks > math.MaxInt64-w.current {
+		ticks = math.MaxInt64 - w.current
+	}
+	t := &task{expire: w.current + ticks, f: f}
+	w.add(t)
+	w.count += 1
+	return Handle{w, t}
+}
+
+// Puts t in the lowest level able to hold it, must be called with lock held.
+func (w *Wheel) add(t *task) {
+	for l := 0; ; l += 1 {
+		if l == len(w.levels) {
+			w.grow()
+		}
+		span := w.spans[l]
+		// The top level holds anything once a level further would overflow.
+		top := span > math.MaxInt64/w.slots
+		if top || t.expire/span-w.current/span < w.slots {
+			bucket := w.levels[l][(t.expire/span)%w.slots]
+			t.bucket, t.elem = bucket, bucket.PushBack(t)
+			return
+		}
+	}
+}
+
+// Adds a level on top, must be called with lock held.
+func (w *Wheel) grow() {
+	span := int64(1)
+	if n := len(w.spans); n > 0 {
+		span = w.spans[n-1] * w.slots
+	}
+	buckets := make([]*list.List, w.slots)
+	for i := range buckets {
+		buckets[i] = list.New()
+	}
+	w.levels = append(w.levels, buckets)
+	w.spans = append(w.spans, span)
+}
+
+// Must be called with lock held.
+func (w *Wheel) remove(t *task) {
+	t.bucket.Remove(t.elem)
+	t.bucket, t.elem = nil, nil
+	w.count -= 1
+}
+
+// Moves the wheel a tick forward and returns the tasks due, must be called with lock held.
+func (w *Wheel) step() []*task {
+	w.current += 1
+	var due []*task
+	// Higher levels first, so tasks moving down to level 0 are due right away.
+	for l := len(w.levels) - 1; l >= 0; l -= 1 {
+		span := w.spans[l]
+		if w.current%span != 0 {
+			continue
+		}
+		bucket := w.levels[l][(w.current/span)%w.slots]
+		var moved []*task
+		for elem := bucket.Front(); elem != nil; elem = elem.Next() {
+			moved = append(moved, elem.Value.(*task))
+		}
+		bucket.Init()
+		for _, t := range moved {
+			t.bucket, t.elem = nil, nil
+			if t.expire <= w.current {
+				w.count -= 1
+				due = append(due, t)
+			} else {
+				w.add(t)
+			}
+		}
+	}
+	return due
+}
+
+// Catches up with the clock one tick at a time, the tasks of a tick run before the next one.
+func (w *Wheel) advance(now time.Time) {
+	target := int64(now.Sub(w.start) / w.tick)
+	for {
+		w.lock.Lock()
+		if w.current >= target || w.stop.Exited() {
+			w.lock.Unlock()
+			return
+		}
+		due := w.step()
+		w.lock.Unlock()
+		for _, t := range due {
+			t.f()
+		}
+	}
+}
+
+func (w *Wheel) loop(t clock.Ticker) {
+	defer close(w.done)
+	defer t.Stop()
+	for {
+		select {
+		case <-w.stop.Chan():
+			return
+		case <-t.C():
+			// Ticks are dropped while tasks run, so the clock is followed rather than the ticker.
+			w.advance(w.clock.Now())
+		}
+	}
+}
+
+// Returns the number of tasks waiting.
+func (w *Wheel) Len() int {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.count
+}
+
+// Stops the wheel and waits for the driving goroutine to exit, the tasks waiting never run.
+func (w *Wheel) Close() {
+	w.stop.Close()
+	<-w.done
+}
@@ -0,0 +1,90 @@
+package timingWheel
+
+import (
+	"github.com/athlum/pkg/clock"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWheel(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	tick := time.Millisecond * 10
+	w, err := NewWithClock(clk, tick, 8)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	current := func() int64 {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.current
+	}
+	const n = 10000
+	fired := make([]int64, n)
+	handles := make([]Handle, n)
+	delays := make([]time.Duration, n)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < n; i += 1 {
+		i := i
+		delays[i] = time.Duration(rand.Int63n(int64(time.Hour)))
+		wg.Add(1)
+		handles[i] = w.Schedule(delays[i], func() {
+			fired[i] = current()
+			wg.Done()
+		})
+	}
+	cancelled := 0
+	for i := 0; i < n; i += 3 {
+		if !handles[i].Cancel() {
+			t.Fatalf("Cancel() of task %v failed", i)
+		}
+		if handles[i].Cancel() {
+			t.Fatalf("task %v cancelled twice", i)
+		}
+		cancelled += 1
+		wg.Done()
+	}
+	if w.Len() != n-cancelled {
+		t.Fatalf("Len() = %v, expect %v", w.Len(), n-cancelled)
+	}
+
+	// The wheel catches up with ticks dropped while it was busy.
+	clk.Advance(time.Minute * 30)
+	clk.Advance(time.Minute * 31)
+	wg.Wait()
+	for i := 0; i < n; i += 1 {
+		expect := int64((delays[i] + tick - 1) / tick)
+		if i%3 == 0 {
+			expect = 0
+		}
+		if fired[i] != expect {
+			t.Fatalf("task %v after %v fired at tick %v, expect %v", i, delays[i], fired[i], expect)
+		}
+		if i%3 != 0 && handles[i].Cancel() {
+			t.Fatalf("Cancel() of task %v succeeded after it ran", i)
+		}
+	}
+	if w.Len() != 0 {
+		t.Fatalf("Len() = %v after every task ran", w.Len())
+	}
+
+	// A zero delay runs on the next tick.
+	ran := make(chan struct{})
+	w.Schedule(0, func() {
+		close(ran)
+	})
+	clk.Advance(tick)
+	<-ran
+
+	w.Close()
+	w.Schedule(tick, func() {
+		t.Fatal("a task ran after Close")
+	})
+	clk.Advance(tick * 2)
+	if _, err := New(0, 8); err == nil {
+		t.Fatal("a zero tick should be invalid")
+	}
+}
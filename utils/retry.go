@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"github.com/athlum/pkg/clock"
 	"github.com/pkg/errors"
 	"time"
 )
@@ -14,6 +15,11 @@ func Retry(f func() error, times int) (err error) {
 }
 
 func Backoff(f func() error, times int, interval, max time.Duration, stopc <-chan struct{}) (err error) {
+	return BackoffWithClock(clock.Real, f, times, interval, max, stopc)
+}
+
+// Same as Backoff, with the intervals waited on clk.
+func BackoffWithClock(clk clock.Clock, f func() error, times int, interval, max time.Duration, stopc <-chan struct{}) (err error) {
 	current := interval
 	for i := 0; i < times; i += 1 {
 		if err = f(); err == nil {
@@ -22,7 +28,7 @@ func Backoff(f func() error, times int, interval, max time.Duration, stopc <-cha
 			select {
 			case <-stopc:
 				return ERROR_RetryStopped
-			case <-time.After(current):
+			case <-clk.After(current):
 				if current < max {
 					current += interval
 					if current >= max {
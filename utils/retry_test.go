@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"github.com/athlum/pkg/clock"
+	"github.com/pkg/errors"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	clk := clock.NewFake(time.Now())
+	attempts := 0
+	done := make(chan error)
+	go func() {
+		done <- BackoffWithClock(clk, func() error {
+			if attempts += 1; attempts < 4 {
+				return errors.New("failed")
+			}
+			return nil
+		}, 5, time.Second, time.Second*2, nil)
+	}()
+	for _, d := range []time.Duration{time.Second, time.Second * 2, time.Second * 2} {
+		clk.BlockUntil(1)
+		clk.Advance(d - time.Millisecond)
+		if clk.Waiters() != 1 {
+			t.Fatalf("retried before %v", d)
+		}
+		clk.Advance(time.Millisecond)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Backoff() = %v", err)
+	}
+	if attempts != 4 {
+		t.Fatalf("%v attempts", attempts)
+	}
+
+	stopc := make(chan struct{})
+	close(stopc)
+	if err := BackoffWithClock(clk, func() error { return errors.New("failed") }, 5, time.Second, time.Second, stopc); err != ERROR_RetryStopped {
+		t.Fatalf("Backoff() = %v after stopped", err)
+	}
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/athlum/pkg/exitChan"
 	"github.com/athlum/pkg/log"
 	"github.com/samuel/go-zookeeper/zk"
+	"hash/fnv"
 	"path"
 	"strings"
 	"sync"
@@ -29,20 +30,17 @@ type NodeEvent struct {
 	Event NodeEventType
 }
 
+// Tree nodes by path, Subscribe to ConcurrentMap for a stream of nodes being added or removed.
 type TreeNodeMap struct {
-	*cmap.ConcurrentMap
+	ConcurrentMap *cmap.Map[string, *TreeNode]
 }
 
 func NewTreeNodeMap() *TreeNodeMap {
-	return &TreeNodeMap{ConcurrentMap: cmap.New()}
+	return &TreeNodeMap{ConcurrentMap: cmap.NewMap[string, *TreeNode](cmap.StringHasher(fnv.New32), 0)}
 }
 
 func (tnm *TreeNodeMap) Get(key string) (*TreeNode, bool) {
-	o, exists := tnm.ConcurrentMap.Get(key)
-	if exists {
-		return o.(*TreeNode), exists
-	}
-	return nil, exists
+	return tnm.ConcurrentMap.Get(key)
 }
 
 func (tnm *TreeNodeMap) SetIfAbsent(key string, value *TreeNode) bool {
@@ -62,31 +60,23 @@ func (tnm *TreeNodeMap) Remove(key string) {
 }
 
 func (tnm *TreeNodeMap) Loop(f func(key string, node *TreeNode) bool) {
-	for e := range tnm.ConcurrentMap.IterBuffered() {
-		if breaked := f(e.Key, e.Val.(*TreeNode)); breaked {
-			break
-		}
-	}
+	tnm.ConcurrentMap.Range(func(key string, node *TreeNode) bool {
+		breaked := f(key, node)
+		return !breaked
+	})
 }
 
+// Deprecated: a TreeNode stops through an exitChan.Group, NodeStop is kept for compatibility.
 type NodeStop struct {
-	childStop *exitChan.ExitChan
-	stop      *exitChan.ExitChan
-	flushStop *exitChan.ExitChan
+	*exitChan.Group
 }
 
 func (ns *NodeStop) Stop() {
-	ns.stop.Close()
-	ns.childStop.Close()
-	ns.flushStop.Close()
+	ns.Close()
 }
 
 func NewNodeStop() *NodeStop {
-	return &NodeStop{
-		childStop: exitChan.NewExitChan(),
-		stop:      exitChan.NewExitChan(),
-		flushStop: exitChan.NewExitChan(),
-	}
+	return &NodeStop{exitChan.NewGroup()}
 }
 
 type syncVersion struct {
@@ -101,6 +91,12 @@ func newSyncVersion() *syncVersion {
 	}
 }
 
+func (sv *syncVersion) Get() int32 {
+	sv.lock.Lock()
+	defer sv.lock.Unlock()
+	return sv.version
+}
+
 func (sv *syncVersion) Update(v int32) bool {
 	sv.lock.Lock()
 	defer sv.lock.Unlock()
@@ -122,7 +118,7 @@ type TreeNode struct {
 	zk       *ZK
 	version  *syncVersion
 	cversion *syncVersion
-	stop     *NodeStop
+	stop     *exitChan.Group // A child of the group of the parent, or of the ZK for a root.
 	interval time.Duration
 	cleared  int32
 }
@@ -138,7 +134,6 @@ func NewTreeNode(conn *ZK, path, node string, parent *TreeNode, interval time.Du
 		Event:    make(chan *NodeEvent),
 		version:  newSyncVersion(),
 		cversion: newSyncVersion(),
-		stop:     NewNodeStop(),
 		zk:       conn,
 		interval: interval,
 	}
@@ -161,6 +156,9 @@ func NewTreeNode(conn *ZK, path, node string, parent *TreeNode, interval time.Du
 		} else {
 			return nil, fmt.Errorf("Parent %v has no root but has parent", parent.Path)
 		}
+		tn.stop = parent.stop.Child()
+	} else {
+		tn.stop = conn.stop.Child()
 	}
 	tn.zk.treeNodes.SetIfAbsent(tn.Path, tn)
 	return tn, nil
@@ -173,7 +171,9 @@ func (tn *TreeNode) Init() error {
 	tn.ChildrenW()
 	tn.GetW()
 	if tn.Root == nil {
-		go tn.Flush(tn.interval)
+		tn.stop.Go(func() {
+			tn.Flush(tn.interval)
+		})
 	}
 	return nil
 }
@@ -188,7 +188,7 @@ func (tn *TreeNode) NodeFlush(fe NodeEventType) {
 }
 
 func (tn *TreeNode) _flush(fe NodeEventType) error {
-	val, stat, err := tn.zk.Conn.Get(tn.Path)
+	val, stat, err := tn.zk.conn.Get(tn.Path)
 	if err != nil {
 		log.With(log.Type("treeNode")).Errorf("Flush failed on %v: %v", tn.Path, err.Error())
 		return err
@@ -204,7 +204,7 @@ func (tn *TreeNode) _flush(fe NodeEventType) error {
 		tn.Emit(ev)
 	}
 
-	children, stat, err := tn.zk.Conn.Children(tn.Path)
+	children, stat, err := tn.zk.conn.Children(tn.Path)
 	if err != nil {
 		log.With(log.Type("treeNode")).Errorf("Flush children failed on %v: %v", tn.Path, err.Error())
 		return err
@@ -234,7 +234,7 @@ func (tn *TreeNode) Flush(interval time.Duration) {
 	defer t.Stop()
 	for {
 		select {
-		case <-tn.stop.flushStop.Chan():
+		case <-tn.stop.Chan():
 			log.With(log.Type("treeNode")).Errorf("Flush stopped on %v.", tn.Path)
 			return
 		case <-t.C:
@@ -257,8 +257,9 @@ func (tn *TreeNode) Echo(e zk.Event) {
 			return
 		}
 	case zk.EventNodeDataChanged:
-		defer tn.GetW()
-		val, stat, err := tn.zk.Conn.Get(tn.Path)
+		// Watch again before reading, so changes made in between aren't missed.
+		tn.GetW()
+		val, stat, err := tn.zk.conn.Get(tn.Path)
 		if err != nil {
 			log.With(log.Type("treeNode")).Errorf("Get has error on %v: %v", tn.Path, err.Error())
 			return
@@ -275,13 +276,13 @@ func (tn *TreeNode) Echo(e zk.Event) {
 		}
 		tn.Emit(ev)
 	case zk.EventNodeChildrenChanged:
-		defer tn.ChildrenW()
-		children, stat, err := tn.zk.Conn.Children(tn.Path)
+		tn.ChildrenW()
+		children, stat, err := tn.zk.conn.Children(tn.Path)
 		if err != nil {
 			log.With(log.Type("treeNode")).Errorf("Children has error on %v: %v", tn.Path, err.Error())
 			return
 		}
-		log.With(log.Type("treeNode")).Infof("e.Type: %v, stat: %#v, %v, %v", e.Type, *stat, tn.cversion.version, children)
+		log.With(log.Type("treeNode")).Infof("e.Type: %v, stat: %#v, %v, %v", e.Type, *stat, tn.cversion.Get(), children)
 		if u := tn.cversion.Update(stat.Cversion); !u {
 			return
 		}
@@ -307,10 +308,10 @@ func (tn *TreeNode) Echo(e zk.Event) {
 
 func (tn *TreeNode) GetW() {
 	for {
-		_, _, _, err := tn.zk.Conn.GetW(tn.Path)
+		_, _, _, err := tn.zk.conn.GetW(tn.Path)
 		if err != nil {
 			log.With(log.Type("treeNode")).Errorf("GetW failed on %v: %v", tn.Path, err.Error())
-			if tn.stop.stop.Exited() || err == zk.ErrNoNode {
+			if tn.stop.Exited() || err == zk.ErrNoNode {
 				if err := tn.Clear(); err != nil {
 					log.With(log.Type("treeNode")).Errorf("Clear failed on %v: %v", tn.Path, err.Error())
 				}
@@ -325,10 +326,10 @@ func (tn *TreeNode) GetW() {
 
 func (tn *TreeNode) ChildrenW() { //Won't deal with events on child removed.
 	for {
-		_, _, _, err := tn.zk.Conn.ChildrenW(tn.Path)
+		_, _, _, err := tn.zk.conn.ChildrenW(tn.Path)
 		if err != nil {
 			log.With(log.Type("treeNode")).Errorf("ChildrenW failed on %v: %v", tn.Path, err.Error())
-			if tn.stop.childStop.Exited() || err == zk.ErrNoNode {
+			if tn.stop.Exited() || err == zk.ErrNoNode {
 				if err := tn.Clear(); err != nil {
 					log.With(log.Type("treeNode")).Errorf("Clear failed on %v: %v", tn.Path, err.Error())
 				}
@@ -350,7 +351,13 @@ func (tn *TreeNode) Clear() error {
 		return nil
 	}
 	atomic.StoreInt32(&tn.cleared, 1)
-	tn.stop.Stop()
+	// Emitted while the node is running, once stopped its events are dropped.
+	tn.Emit(&NodeEvent{
+		Node:  tn.Node,
+		Path:  tn.Path,
+		Event: NodeRemoved,
+	})
+	tn.stop.Close()
 	tn.Children.Loop(func(path string, node *TreeNode) (breaked bool) {
 		if err := node.Clear(); err != nil {
 			log.With(log.Type("treeNode")).Errorf("Clear failed on %v: %v", node.Path, err.Error())
@@ -361,19 +368,18 @@ func (tn *TreeNode) Clear() error {
 	if tn.Parent != nil {
 		go tn.Parent.RemoveChild(tn.Path) //deadlock =.=
 	}
-	tn.Emit(&NodeEvent{
-		Node:  tn.Node,
-		Path:  tn.Path,
-		Event: NodeRemoved,
-	})
 	return nil
 }
 
+// Sends e on the Event of the root, e is dropped once the root is stopped.
 func (tn *TreeNode) Emit(e *NodeEvent) {
 	log.With(log.Type("treeNode"), log.String("path", tn.Path)).Infof("Emit %#v, Root: %v", e, tn.Root)
 	if tn.Root != nil {
 		tn.Root.Emit(e)
-	} else {
-		tn.Event <- e
+		return
+	}
+	select {
+	case tn.Event <- e:
+	case <-tn.stop.Chan():
 	}
 }
@@ -7,33 +7,66 @@ import (
 	"github.com/athlum/pkg/utils"
 	"github.com/samuel/go-zookeeper/zk"
 	"strings"
+	"time"
 )
 
+// The subset of *zk.Conn used by ZK, implemented by zktest.Server sessions in tests.
+type Conn interface {
+	AddAuth(scheme string, auth []byte) error
+	Children(path string) ([]string, *zk.Stat, error)
+	ChildrenW(path string) ([]string, *zk.Stat, <-chan zk.Event, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+	Delete(path string, version int32) error
+	Exists(path string) (bool, *zk.Stat, error)
+	Get(path string) ([]byte, *zk.Stat, error)
+	GetW(path string) ([]byte, *zk.Stat, <-chan zk.Event, error)
+	Set(path string, data []byte, version int32) (*zk.Stat, error)
+	Close()
+}
+
+// Opens a session which calls cb with every event, including fired watches.
+type Dialer func(cfg *Config, cb zk.EventCallback) (Conn, <-chan zk.Event, error)
+
+func dial(cfg *Config, cb zk.EventCallback) (Conn, <-chan zk.Event, error) {
+	return zk.Connect(cfg.Host, utils.Duration(cfg.SessionTimeout), zk.WithEventCallback(cb))
+}
+
 type ZK struct {
-	Conn      *zk.Conn
+	Conn      *zk.Conn // Nil if the session of a Dialer isn't a *zk.Conn, see Session.
+	conn      Conn
 	Ec        <-chan zk.Event
 	RootPath  string
 	Auth      []byte
 	Address   string
 	Acls      []zk.ACL
 	treeNodes *TreeNodeMap
-	stop      *exitChan.ExitChan
+	stop      *exitChan.Group // The parent of the groups of the tree nodes.
 }
 
 func NewZK(cfg *Config) *ZK {
+	client, err := NewZKWithDialer(cfg, dial)
+	if err != nil {
+		panic(err)
+	}
+	return client
+}
+
+// Same as NewZK but connects through dial and returns the errors instead of panicking.
+func NewZKWithDialer(cfg *Config, dial Dialer) (*ZK, error) {
 	client := &ZK{
 		Auth:      []byte(cfg.Auth),
 		RootPath:  cfg.RootPath,
 		Address:   utils.GetLocalIP(),
 		treeNodes: NewTreeNodeMap(),
-		stop:      exitChan.NewExitChan(),
+		stop:      exitChan.NewGroup(),
 	}
 
-	conn, ec, err := zk.Connect(cfg.Host, utils.Duration(cfg.SessionTimeout), zk.WithEventCallback(client.eventCallback))
+	conn, ec, err := dial(cfg, client.eventCallback)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	client.Conn = conn
+	client.conn = conn
+	client.Conn, _ = conn.(*zk.Conn)
 	client.Ec = ec
 
 	if cfg.Auth != "" {
@@ -43,27 +76,37 @@ func NewZK(cfg *Config) *ZK {
 		client.Acls = append(acls, zk.WorldACL(zk.PermRead)...)
 	}
 
-	if err := client.Conn.AddAuth("digest", client.Auth); err != nil {
-		panic(err)
+	if err := client.conn.AddAuth("digest", client.Auth); err != nil {
+		return nil, err
 	}
 	if err := client.CheckRoot(); err != nil {
 		log.With(log.Type("zk")).Errorf("Check root error: %v", err.Error())
 	}
 	// go client.WatchEvent()
-	return client
+	return client, nil
+}
+
+// Returns the session, the same as Conn unless another Conn was opened by the Dialer.
+func (o *ZK) Session() Conn {
+	return o.conn
 }
 
 func (o *ZK) CheckRoot() error {
-	tempPath := bytes.NewBuffer([]byte{o.RootPath[0]})
-	pathList := strings.Split(string(o.RootPath[1:]), "/")
+	return o.EnsurePath(o.RootPath)
+}
+
+// Creates the missing persistent nodes of the absolute path p.
+func (o *ZK) EnsurePath(p string) error {
+	tempPath := bytes.NewBuffer([]byte{p[0]})
+	pathList := strings.Split(string(p[1:]), "/")
 	for _, value := range pathList {
 		tempPath.WriteString(value)
-		exists, _, err := o.Conn.Exists(tempPath.String())
+		exists, _, err := o.conn.Exists(tempPath.String())
 		if err != nil {
 			return err
 		}
 		if !exists {
-			if _, err := o.Conn.Create(tempPath.String(), []byte{}, 0, o.Acls); err != nil {
+			if _, err := o.conn.Create(tempPath.String(), []byte{}, 0, o.Acls); err != nil && err != zk.ErrNodeExists {
 				return err
 			}
 		}
@@ -72,14 +115,22 @@ func (o *ZK) CheckRoot() error {
 	return nil
 }
 
+// Starts stopping the tree nodes and clears them, use Shutdown to wait for them.
 func (o *ZK) Stop() {
-	defer o.stop.Close()
+	// Closed first, so the removals of the nodes aren't stuck on Event without a reader.
+	o.stop.Close()
 	o.treeNodes.Loop(func(k string, node *TreeNode) bool {
 		node.Clear()
 		return false
 	})
 }
 
+// Same as Stop, then waits for the tree nodes to stop, for at most timeout unless it is 0.
+func (o *ZK) Shutdown(timeout time.Duration) error {
+	o.Stop()
+	return o.stop.Shutdown(timeout)
+}
+
 func (o *ZK) WatchEvent() {
 	for {
 		select {
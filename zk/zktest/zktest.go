@@ -0,0 +1,394 @@
+// An in-process zookeeper for tests, sessions implement zk.Conn and deliver watches
+// the same way the real client does.
+package zktest
+
+import (
+	"fmt"
+	pzk "github.com/athlum/pkg/zk"
+	"github.com/samuel/go-zookeeper/zk"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type node struct {
+	data     []byte
+	stat     zk.Stat
+	children map[string]struct{}
+	seq      int32
+}
+
+type watchKey struct {
+	path  string
+	child bool
+}
+
+type Server struct {
+	lock     sync.Mutex
+	nodes    map[string]*node
+	sessions map[int64]*Session
+	zxid     int64
+	nextID   int64
+}
+
+func NewServer() *Server {
+	return &Server{
+		nodes: map[string]*node{
+			"/": {children: make(map[string]struct{})},
+		},
+		sessions: make(map[int64]*Session),
+	}
+}
+
+// Opens a new session, it could be used as a zk.Dialer.
+func (s *Server) Dial(cfg *pzk.Config, cb zk.EventCallback) (pzk.Conn, <-chan zk.Event, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.nextID += 1
+	sess := &Session{
+		id:      s.nextID,
+		server:  s,
+		cb:      cb,
+		ec:      make(chan zk.Event, 16),
+		watches: make(map[watchKey][]chan zk.Event),
+	}
+	s.sessions[sess.id] = sess
+	return sess, sess.ec, nil
+}
+
+// Returns the paths of every node, sorted.
+func (s *Server) Paths() []string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	ps := make([]string, 0, len(s.nodes))
+	for p := range s.nodes {
+		ps = append(ps, p)
+	}
+	sort.Strings(ps)
+	return ps
+}
+
+type fired struct {
+	sess *Session
+	ev   zk.Event
+	chs  []chan zk.Event
+}
+
+// Collects the watches on key, must be called with lock held.
+func (s *Server) trigger(out []fired, key watchKey, typ zk.EventType) []fired {
+	for _, sess := range s.sessions {
+		if chs, ok := sess.watches[key]; ok {
+			delete(sess.watches, key)
+			out = append(out, fired{sess, zk.Event{Type: typ, State: zk.StateHasSession, Path: key.path}, chs})
+		}
+	}
+	return out
+}
+
+// Delivers fired watches, must be called without lock held.
+func deliver(fs []fired) {
+	for _, f := range fs {
+		for _, ch := range f.chs {
+			ch <- f.ev
+		}
+		f.sess.send(f.ev)
+	}
+}
+
+// Must be called with lock held.
+func (s *Server) create(owner int64, p string, data []byte, flags int32) (string, []fired, error) {
+	if p == "" || p[0] != '/' || (len(p) > 1 && strings.HasSuffix(p, "/")) {
+		return "", nil, zk.ErrInvalidPath
+	}
+	parentPath, name := path.Split(p)
+	parentPath = path.Clean(parentPath)
+	parent, ok := s.nodes[parentPath]
+	if !ok {
+		return "", nil, zk.ErrNoNode
+	}
+	if parent.stat.EphemeralOwner != 0 {
+		return "", nil, zk.ErrNoChildrenForEphemerals
+	}
+	if flags&zk.FlagSequence != 0 {
+		name = fmt.Sprintf("%v%010d", name, parent.seq)
+		p = path.Join(parentPath, name)
+	}
+	if _, ok := s.nodes[p]; ok {
+		return "", nil, zk.ErrNodeExists
+	}
+	s.zxid += 1
+	n := &node{
+		data:     append([]byte{}, data...),
+		children: make(map[string]struct{}),
+		stat: zk.Stat{
+			Czxid:      s.zxid,
+			Mzxid:      s.zxid,
+			Ctime:      time.Now().UnixNano() / int64(time.Millisecond),
+			DataLength: int32(len(data)),
+		},
+	}
+	n.stat.Mtime = n.stat.Ctime
+	if flags&zk.FlagEphemeral != 0 {
+		n.stat.EphemeralOwner = owner
+	}
+	s.nodes[p] = n
+	parent.children[name] = struct{}{}
+	parent.seq += 1
+	parent.stat.Cversion += 1
+	parent.stat.NumChildren = int32(len(parent.children))
+	parent.stat.Pzxid = s.zxid
+	fs := s.trigger(nil, watchKey{p, false}, zk.EventNodeCreated)
+	fs = s.trigger(fs, watchKey{parentPath, true}, zk.EventNodeChildrenChanged)
+	return p, fs, nil
+}
+
+// Must be called with lock held.
+func (s *Server) delete(p string, version int32) ([]fired, error) {
+	n, ok := s.nodes[p]
+	if !ok || p == "/" {
+		return nil, zk.ErrNoNode
+	}
+	if version != -1 && version != n.stat.Version {
+		return nil, zk.ErrBadVersion
+	}
+	if len(n.children) > 0 {
+		return nil, zk.ErrNotEmpty
+	}
+	s.zxid += 1
+	delete(s.nodes, p)
+	parentPath, name := path.Split(p)
+	parentPath = path.Clean(parentPath)
+	parent := s.nodes[parentPath]
+	delete(parent.children, name)
+	parent.stat.Cversion += 1
+	parent.stat.NumChildren = int32(len(parent.children))
+	parent.stat.Pzxid = s.zxid
+	fs := s.trigger(nil, watchKey{p, false}, zk.EventNodeDeleted)
+	fs = s.trigger(fs, watchKey{p, true}, zk.EventNodeDeleted)
+	fs = s.trigger(fs, watchKey{parentPath, true}, zk.EventNodeChildrenChanged)
+	return fs, nil
+}
+
+// Must be called with lock held.
+func (s *Server) set(p string, data []byte, version int32) (*zk.Stat, []fired, error) {
+	n, ok := s.nodes[p]
+	if !ok {
+		return nil, nil, zk.ErrNoNode
+	}
+	if version != -1 && version != n.stat.Version {
+		return nil, nil, zk.ErrBadVersion
+	}
+	s.zxid += 1
+	n.data = append([]byte{}, data...)
+	n.stat.Version += 1
+	n.stat.Mzxid = s.zxid
+	n.stat.Mtime = time.Now().UnixNano() / int64(time.Millisecond)
+	n.stat.DataLength = int32(len(data))
+	stat := n.stat
+	return &stat, s.trigger(nil, watchKey{p, false}, zk.EventNodeDataChanged), nil
+}
+
+// Closes the session, its ephemeral nodes are deleted.
+func (s *Server) closeSession(id int64) []fired {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.sessions[id]; !ok {
+		return nil
+	}
+	delete(s.sessions, id)
+	var fs []fired
+	for p, n := range s.nodes {
+		if n.stat.EphemeralOwner == id {
+			more, _ := s.delete(p, -1)
+			fs = append(fs, more...)
+		}
+	}
+	return fs
+}
+
+// A client session, ephemeral nodes it creates are removed when it is closed or expired.
+type Session struct {
+	id      int64
+	server  *Server
+	cb      zk.EventCallback
+	ec      chan zk.Event
+	lock    sync.Mutex
+	closed  bool
+	watches map[watchKey][]chan zk.Event // Guarded by server.lock.
+}
+
+func (c *Session) SessionID() int64 {
+	return c.id
+}
+
+func (c *Session) send(ev zk.Event) {
+	if c.cb != nil {
+		c.cb(ev)
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.ec <- ev:
+	default:
+	}
+}
+
+func (c *Session) alive() error {
+	if _, ok := c.server.sessions[c.id]; !ok {
+		return zk.ErrConnectionClosed
+	}
+	return nil
+}
+
+// Must be called with server lock held.
+func (c *Session) watch(key watchKey) <-chan zk.Event {
+	ch := make(chan zk.Event, 1)
+	c.watches[key] = append(c.watches[key], ch)
+	return ch
+}
+
+func (c *Session) AddAuth(scheme string, auth []byte) error {
+	return nil
+}
+
+func (c *Session) Children(p string) ([]string, *zk.Stat, error) {
+	children, stat, _, err := c.children(p, false)
+	return children, stat, err
+}
+
+func (c *Session) ChildrenW(p string) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	return c.children(p, true)
+}
+
+func (c *Session) children(p string, watch bool) ([]string, *zk.Stat, <-chan zk.Event, error) {
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	if err := c.alive(); err != nil {
+		return nil, nil, nil, err
+	}
+	n, ok := c.server.nodes[p]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	children := make([]string, 0, len(n.children))
+	for name := range n.children {
+		children = append(children, name)
+	}
+	sort.Strings(children)
+	stat := n.stat
+	var ch <-chan zk.Event
+	if watch {
+		ch = c.watch(watchKey{p, true})
+	}
+	return children, &stat, ch, nil
+}
+
+func (c *Session) Get(p string) ([]byte, *zk.Stat, error) {
+	data, stat, _, err := c.get(p, false)
+	return data, stat, err
+}
+
+func (c *Session) GetW(p string) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	return c.get(p, true)
+}
+
+func (c *Session) get(p string, watch bool) ([]byte, *zk.Stat, <-chan zk.Event, error) {
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	if err := c.alive(); err != nil {
+		return nil, nil, nil, err
+	}
+	n, ok := c.server.nodes[p]
+	if !ok {
+		return nil, nil, nil, zk.ErrNoNode
+	}
+	stat := n.stat
+	var ch <-chan zk.Event
+	if watch {
+		ch = c.watch(watchKey{p, false})
+	}
+	return append([]byte{}, n.data...), &stat, ch, nil
+}
+
+func (c *Session) Exists(p string) (bool, *zk.Stat, error) {
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	if err := c.alive(); err != nil {
+		return false, nil, err
+	}
+	n, ok := c.server.nodes[p]
+	if !ok {
+		return false, nil, nil
+	}
+	stat := n.stat
+	return true, &stat, nil
+}
+
+func (c *Session) Create(p string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	c.server.lock.Lock()
+	err := c.alive()
+	var created string
+	var fs []fired
+	if err == nil {
+		created, fs, err = c.server.create(c.id, p, data, flags)
+	}
+	c.server.lock.Unlock()
+	deliver(fs)
+	return created, err
+}
+
+func (c *Session) Delete(p string, version int32) error {
+	c.server.lock.Lock()
+	err := c.alive()
+	var fs []fired
+	if err == nil {
+		fs, err = c.server.delete(p, version)
+	}
+	c.server.lock.Unlock()
+	deliver(fs)
+	return err
+}
+
+func (c *Session) Set(p string, data []byte, version int32) (*zk.Stat, error) {
+	c.server.lock.Lock()
+	err := c.alive()
+	var stat *zk.Stat
+	var fs []fired
+	if err == nil {
+		stat, fs, err = c.server.set(p, data, version)
+	}
+	c.server.lock.Unlock()
+	deliver(fs)
+	return stat, err
+}
+
+// Closes the session like a client leaving, its ephemeral nodes are deleted.
+func (c *Session) Close() {
+	deliver(c.server.closeSession(c.id))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.ec)
+	}
+}
+
+// Expires the session like the server losing the client, watchers of the session
+// receive EventNotWatching and its ephemeral nodes are deleted.
+func (c *Session) Expire() {
+	fs := c.server.closeSession(c.id)
+	c.server.lock.Lock()
+	watches := c.watches
+	c.watches = make(map[watchKey][]chan zk.Event)
+	c.server.lock.Unlock()
+	for key, chs := range watches {
+		fs = append(fs, fired{c, zk.Event{Type: zk.EventNotWatching, State: zk.StateExpired, Path: key.path, Err: zk.ErrSessionExpired}, chs})
+	}
+	deliver(fs)
+	c.send(zk.Event{Type: zk.EventSession, State: zk.StateExpired})
+}